@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const batchResultKey = "batchResult"
+
+var (
+	// batchSlots limits the number of batch items processed at once across all requests
+	batchSlots chan struct{}
+
+	// batchPipeline is the upload chain without reading the request
+	batchPipeline echo.HandlerFunc
+)
+
+func initBatch() {
+	batchSlots = make(chan struct{}, config.Iris.Concurrency)
+	batchPipeline = parseUploadOptions(checkTypeAndDimensions(process(genID(genObjectURL(storeBatchItem)))))
+}
+
+func storeBatchItem(c echo.Context) error {
+	res, err := storeImage(c)
+	if err != nil {
+		return err
+	}
+
+	c.Set(batchResultKey, res)
+	return nil
+}
+
+// batchUpload processes every "image" part on its own. A bad file fails its item only.
+func batchUpload(c echo.Context) error {
+	log.Debug("Start batchUpload")
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		log.Debug(err)
+		return echo.NewHTTPError(http.StatusBadRequest, errImageMissing)
+	}
+
+	files := form.File["image"]
+	if len(files) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errImageMissing)
+	}
+
+	if config.Iris.MaxBatchSize > 0 && len(files) > config.Iris.MaxBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Too many images, max %d", config.Iris.MaxBatchSize))
+	}
+
+	results := make([]map[string]interface{}, len(files))
+
+	var wg sync.WaitGroup
+
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f *multipart.FileHeader) {
+			defer wg.Done()
+
+			batchSlots <- struct{}{}
+			defer func() { <-batchSlots }()
+
+			res, err := processBatchItem(c, f)
+			if err != nil {
+				res = map[string]interface{}{"error": batchItemError(err)}
+			}
+			res["index"] = i
+
+			results[i] = res
+		}(i, f)
+	}
+
+	wg.Wait()
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"images": results})
+}
+
+func processBatchItem(c echo.Context, f *multipart.FileHeader) (map[string]interface{}, error) {
+	if f.Size > config.Iris.MaxFileSize {
+		return nil, errSourceFileTooBig
+	}
+
+	imgFile, err := f.Open()
+	if err != nil {
+		log.Debug(err)
+		return nil, errImageMissing
+	}
+	defer imgFile.Close()
+
+	// Every item gets its own context, the pipeline keeps its state there.
+	// Nothing in the pipeline writes to the response.
+	ic := e.NewContext(c.Request(), c.Response().Writer)
+	ic.Set(startTimeKey, time.Now())
+	ic.Set(imageFileKey, imgFile)
+	ic.Set(imageFileSizeKey, f.Size)
+
+	if err := batchPipeline(ic); err != nil {
+		return nil, err
+	}
+
+	return ic.Get(batchResultKey).(map[string]interface{}), nil
+}
+
+func batchItemError(err error) interface{} {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return fmt.Sprintf("%v", he.Message)
+	}
+	return err.Error()
+}
@@ -0,0 +1,154 @@
+//go:build ceph
+// +build ceph
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ceph/go-ceph/rados"
+)
+
+type cephTransport struct {
+	conn *rados.Conn
+
+	mutex    *sync.Mutex
+	contexts map[string]*rados.IOContext
+}
+
+func newCephTransport() http.RoundTripper {
+	conf := config.Storage.Ceph
+
+	conn, err := rados.NewConnWithUser(conf.User)
+	if err != nil {
+		log.Fatalf("Can't create Ceph connection: %s", err)
+	}
+
+	if len(conf.ConfFile) > 0 {
+		err = conn.ReadConfigFile(conf.ConfFile)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		log.Fatalf("Can't read Ceph config: %s", err)
+	}
+
+	if err = conn.Connect(); err != nil {
+		log.Fatalf("Can't connect to Ceph: %s", err)
+	}
+
+	return cephTransport{
+		conn:     conn,
+		mutex:    &sync.Mutex{},
+		contexts: make(map[string]*rados.IOContext),
+	}
+}
+
+func (t cephTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return t.readObject(req)
+	case http.MethodPut:
+		return t.writeObject(req)
+	case http.MethodDelete:
+		return t.deleteObject(req)
+	default:
+		return newStorageResponse(req, http.StatusMethodNotAllowed), nil
+	}
+}
+
+// ioContext returns the cached IO context of the pool, opening it on first use
+func (t cephTransport) ioContext(pool string) (*rados.IOContext, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if ioctx, ok := t.contexts[pool]; ok {
+		return ioctx, nil
+	}
+
+	ioctx, err := t.conn.OpenIOContext(pool)
+	if err != nil {
+		return nil, err
+	}
+	t.contexts[pool] = ioctx
+
+	return ioctx, nil
+}
+
+func (t cephTransport) readObject(req *http.Request) (resp *http.Response, err error) {
+	ioctx, err := t.ioContext(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	oid := strings.TrimPrefix(req.URL.Path, "/")
+
+	stat, err := ioctx.Stat(oid)
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	etag := fmt.Sprintf("%x-%x", stat.ModTime.Unix(), stat.Size)
+
+	if req.Method == http.MethodHead {
+		return newStorageObjectResponse(req, nil, int64(stat.Size), "", etag, stat.ModTime), nil
+	}
+
+	data := make([]byte, stat.Size)
+
+	n, err := ioctx.Read(oid, data, 0)
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageObjectResponse(req, ioutil.NopCloser(bytes.NewReader(data[:n])), int64(n), "", etag, stat.ModTime), nil
+}
+
+func (t cephTransport) writeObject(req *http.Request) (resp *http.Response, err error) {
+	ioctx, err := t.ioContext(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ioctx.WriteFull(strings.TrimPrefix(req.URL.Path, "/"), data); err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
+
+func (t cephTransport) deleteObject(req *http.Request) (resp *http.Response, err error) {
+	ioctx, err := t.ioContext(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ioctx.Delete(strings.TrimPrefix(req.URL.Path, "/")); err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
+
+// errorResponse turns rados errors into responses with the matching status
+func (t cephTransport) errorResponse(req *http.Request, err error) (*http.Response, error) {
+	switch err {
+	case rados.RadosErrorNotFound:
+		return newStorageResponse(req, http.StatusNotFound), nil
+	case rados.RadosErrorPermissionDenied:
+		return newStorageResponse(req, http.StatusForbidden), nil
+	default:
+		return nil, err
+	}
+}
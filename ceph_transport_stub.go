@@ -0,0 +1,12 @@
+//go:build !ceph
+// +build !ceph
+
+package main
+
+import "net/http"
+
+// Ceph needs librados, so its transport is built only with -tags ceph
+func newCephTransport() http.RoundTripper {
+	log.Fatal("Ceph storage is enabled but iris is built without it, rebuild with -tags ceph")
+	return nil
+}
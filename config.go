@@ -8,7 +8,22 @@ import (
 	"github.com/spf13/viper"
 )
 
+// watermarkConfig describes a named watermark: one source and the default options
+type watermarkConfig struct {
+	Data     string  `mapstructure:"data"`
+	Path     string  `mapstructure:"path"`
+	Object   string  `mapstructure:"object"`
+	Opacity  float64 `mapstructure:"opacity"`
+	Position string  `mapstructure:"position"`
+	OffsetX  int     `mapstructure:"offset_x"`
+	OffsetY  int     `mapstructure:"offset_y"`
+	Scale    float64 `mapstructure:"scale"`
+}
+
 var (
+	// configViper is kept to re-read the parts that can be reloaded
+	configViper *viper.Viper
+
 	// Schema of IRIS configuration
 	config = struct {
 		PProf struct {
@@ -29,7 +44,50 @@ var (
 			MaxFileSize                    int64         `mapstructure:"max_file_size"`
 			BufferSize                     int           `mapstructure:"upload_buffer_size"`
 			BufferPoolCalibrationThreshold int           `mapstructure:"buffer_pool_calib_threshold"`
+			DownloadTimeout                time.Duration `mapstructure:"download_timeout"`
+			AllowPrivateSources            bool          `mapstructure:"allow_private_sources"`
+			MaxBatchSize                   int           `mapstructure:"max_batch_size"`
+			ResumableDir                   string        `mapstructure:"resumable_dir"`
+			ResumableTTL                   time.Duration `mapstructure:"resumable_ttl"`
+			PreserveOriginal               bool          `mapstructure:"preserve_original"`
+			JobWorkers                     int           `mapstructure:"job_workers"`
+			JobQueueSize                   int           `mapstructure:"job_queue_size"`
+			JobTTL                         time.Duration `mapstructure:"job_ttl"`
 		} `mapstructure:"one_image"`
+		Signature struct {
+			Unsafe    bool   `mapstructure:"unsafe"`
+			ActiveKey string `mapstructure:"active_key"`
+			Keyring   []struct {
+				ID   string `mapstructure:"id"`
+				Key  string `mapstructure:"key"`
+				Salt string `mapstructure:"salt"`
+			} `mapstructure:"keyring"`
+		} `mapstructure:"signature"`
+		Admin struct {
+			Token string `mapstructure:"token"`
+		} `mapstructure:"admin"`
+		Presets    map[string]string `mapstructure:"presets"`
+		Renditions []struct {
+			Name    string `mapstructure:"name"`
+			Width   int    `mapstructure:"width"`
+			Height  int    `mapstructure:"height"`
+			Resize  string `mapstructure:"resize"`
+			Format  string `mapstructure:"format"`
+			Quality int    `mapstructure:"quality"`
+		} `mapstructure:"renditions"`
+		Watermarks map[string]watermarkConfig `mapstructure:"watermarks"`
+		Webhooks   struct {
+			Enabled        bool          `mapstructure:"enabled"`
+			URLs           []string      `mapstructure:"urls"`
+			Events         []string      `mapstructure:"events"`
+			Secret         string        `mapstructure:"secret"`
+			Timeout        time.Duration `mapstructure:"timeout"`
+			Workers        int           `mapstructure:"workers"`
+			QueueSize      int           `mapstructure:"queue_size"`
+			MaxAttempts    int           `mapstructure:"max_attempts"`
+			RetryInterval  time.Duration `mapstructure:"retry_interval"`
+			DeadLetterFile string        `mapstructure:"dead_letter_file"`
+		} `mapstructure:"webhooks"`
 		Image struct {
 			Width            int     `mapstructure:"width"`
 			Height           int     `mapstructure:"height"`
@@ -41,18 +99,61 @@ var (
 			JpegProgressive  bool    `mapstructure:"jpeg_progressive"`
 			PngInterlaced    bool    `mapstructure:"png_interlaced"`
 			WatermarkOpacity float64 `mapstructure:"watermark_opacity"`
+			WatermarkData    string  `mapstructure:"watermark_data"`
+			WatermarkPath    string  `mapstructure:"watermark_path"`
+			WatermarkObject  string  `mapstructure:"watermark_object"`
 			MaxGifFrames     int     `mapstructure:"max_gif_frames"`
 		} `mapstructure:"image"`
 		Storage struct {
 			GCS struct {
-				Enabled      bool   `mapstructure:"enabled"`
-				BucketPrefix string `mapstructure:"bucket_prefix"`
-				BaseURL      string `mapstructure:"base_url"`
-				Prefix       string `mapstructure:"prefix"`
-				ImageConfig  string `mapstructure:"image_config"`
-				ThumbConfig  string `mapstructure:"thumb_config"`
-				Format       string `mapstructure:"format"`
+				Enabled         bool   `mapstructure:"enabled"`
+				BucketPrefix    string `mapstructure:"bucket_prefix"`
+				BaseURL         string `mapstructure:"base_url"`
+				Prefix          string `mapstructure:"prefix"`
+				ImageConfig     string `mapstructure:"image_config"`
+				ThumbConfig     string `mapstructure:"thumb_config"`
+				RenditionConfig string `mapstructure:"rendition_config"`
+				Format          string `mapstructure:"format"`
 			} `mapstructure: "gcs"`
+			S3 struct {
+				Enabled           bool   `mapstructure:"enabled"`
+				Endpoint          string `mapstructure:"endpoint"`
+				Region            string `mapstructure:"region"`
+				Bucket            string `mapstructure:"bucket"`
+				ForcePathStyle    bool   `mapstructure:"force_path_style"`
+				AccessKeyID       string `mapstructure:"access_key_id"`
+				SecretAccessKey   string `mapstructure:"secret_access_key"`
+				PartSize          int64  `mapstructure:"part_size"`
+				UploadConcurrency int    `mapstructure:"upload_concurrency"`
+			} `mapstructure:"s3"`
+			Ceph struct {
+				Enabled  bool   `mapstructure:"enabled"`
+				ConfFile string `mapstructure:"conf_file"`
+				Pool     string `mapstructure:"pool"`
+				User     string `mapstructure:"user"`
+			} `mapstructure:"ceph"`
+			Retry struct {
+				MaxAttempts int           `mapstructure:"max_attempts"`
+				BaseDelay   time.Duration `mapstructure:"base_delay"`
+				MaxDelay    time.Duration `mapstructure:"max_delay"`
+				Statuses    []string      `mapstructure:"statuses"`
+			} `mapstructure:"retry"`
+			Replication struct {
+				Enabled           bool          `mapstructure:"enabled"`
+				Secondaries       []string      `mapstructure:"secondaries"`
+				Mode              string        `mapstructure:"mode"`
+				Quorum            int           `mapstructure:"quorum"`
+				RepairQueueSize   int           `mapstructure:"repair_queue_size"`
+				RepairQueueBytes  int           `mapstructure:"repair_queue_bytes"`
+				RepairInterval    time.Duration `mapstructure:"repair_interval"`
+				RepairMaxAttempts int           `mapstructure:"repair_max_attempts"`
+				Timeout           time.Duration `mapstructure:"timeout"`
+			} `mapstructure:"replication"`
+			File struct {
+				Enabled bool   `mapstructure:"enabled"`
+				Root    string `mapstructure:"root"`
+				Bucket  string `mapstructure:"bucket"`
+			} `mapstructure:"file"`
 		} `mapstructure:"storage"`
 	}{}
 )
@@ -61,6 +162,7 @@ var (
 func init() {
 	// Initialize viper default instance with API base config.
 	v := viper.New()
+	configViper = v
 	v.SetConfigName("config")        // Name of config file (without extension).
 	v.AddConfigPath(".")             // Look for config in current directory
 	v.AddConfigPath("/app")          // Look for config in current directory
@@ -89,5 +191,32 @@ func init() {
 		config.Iris.MaxConn = config.Iris.Concurrency * 10
 	}
 
-	log.Infof("Current configuration: %+v", config)
+	log.Infof("Current configuration: %+v", redactedConfig())
+}
+
+// redactedConfig is the config with keys and secrets masked, so it can go to the logs
+func redactedConfig() interface{} {
+	const masked = "<redacted>"
+
+	c := config
+
+	c.Signature.Keyring = append(c.Signature.Keyring[:0:0], c.Signature.Keyring...)
+	for i := range c.Signature.Keyring {
+		c.Signature.Keyring[i].Key = masked
+		c.Signature.Keyring[i].Salt = masked
+	}
+
+	if len(c.Storage.S3.SecretAccessKey) > 0 {
+		c.Storage.S3.SecretAccessKey = masked
+	}
+
+	if len(c.Admin.Token) > 0 {
+		c.Admin.Token = masked
+	}
+
+	if len(c.Webhooks.Secret) > 0 {
+		c.Webhooks.Secret = masked
+	}
+
+	return c
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// keyID.signature, the CDN picks the key by its ID.
+// Signatures without ID come from the legacy ONEIMAGE__SECRET_KEY pair.
+const signatureKeyIDSeparator = "."
+
+var (
+	errInvalidSignature         = errors.New("Invalid signature")
+	errInvalidSignatureEncoding = errors.New("Invalid signature encoding")
+	errUnknownSignatureKey      = errors.New("Unknown signature key")
+
+	signatureKeyIDRegex = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+)
+
+type signatureKey struct {
+	id   string
+	key  []byte
+	salt []byte
+}
+
+var (
+	// signatureKeys are accepted while verifying incoming paths.
+	// Keeping the old pairs here lets us rotate keys without breaking already published URLs.
+	signatureKeys []signatureKey
+
+	// activeSignatureKey signs every URL we give out, nil if signing is disabled
+	activeSignatureKey *signatureKey
+)
+
+func initSignatureKeys() {
+	if saltKey != nil && secretKey != nil {
+		signatureKeys = append(signatureKeys, signatureKey{"", secretKey, saltKey})
+	}
+
+	for i, k := range config.Signature.Keyring {
+		if !signatureKeyIDRegex.MatchString(k.ID) {
+			log.Fatalf("Signature key #%d has invalid id %q", i, k.ID)
+		}
+
+		if _, ok := findSignatureKey(k.ID); ok {
+			log.Fatalf("Signature key %s is defined twice", k.ID)
+		}
+
+		key, err := hex.DecodeString(k.Key)
+		if err != nil {
+			log.Fatalf("Signature key %s is not a valid hex string", k.ID)
+		}
+
+		salt, err := hex.DecodeString(k.Salt)
+		if err != nil {
+			log.Fatalf("Signature salt %s is not a valid hex string", k.ID)
+		}
+
+		signatureKeys = append(signatureKeys, signatureKey{k.ID, key, salt})
+	}
+
+	activeID := config.Signature.ActiveKey
+
+	if k, ok := findSignatureKey(activeID); ok {
+		activeSignatureKey = &k
+	} else if len(activeID) > 0 {
+		log.Fatalf("Active signature key %s is not in the keyring", activeID)
+	}
+
+	if config.Signature.Unsafe {
+		log.Warn("Signature verification is disabled, don't use unsafe mode in production")
+	} else if len(signatureKeys) == 0 {
+		log.Warn("No signature keys configured, every signed path will be rejected")
+	}
+}
+
+func findSignatureKey(id string) (signatureKey, bool) {
+	for _, k := range signatureKeys {
+		if k.id == id {
+			return k, true
+		}
+	}
+	return signatureKey{}, false
+}
+
+func signatureFor(path string, k signatureKey) []byte {
+	mac := hmac.New(sha256.New, k.key)
+	mac.Write(k.salt)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+func signPath(path string) string {
+	k := activeSignatureKey
+
+	signature := base64.RawURLEncoding.EncodeToString(signatureFor(path, *k))
+	if len(k.id) > 0 {
+		signature = k.id + signatureKeyIDSeparator + signature
+	}
+
+	return fmt.Sprintf("%s%s", signature, path)
+}
+
+// validatePath checks the signature in constant time against the key it names.
+// Unprefixed signatures are only checked against the legacy pair.
+func validatePath(signature, path string) error {
+	id := ""
+	if sep := strings.Index(signature, signatureKeyIDSeparator); sep >= 0 {
+		id, signature = signature[:sep], signature[sep+1:]
+	}
+
+	k, ok := findSignatureKey(id)
+	if !ok {
+		if len(id) == 0 {
+			return errInvalidSignature
+		}
+		return errUnknownSignatureKey
+	}
+
+	messageMAC, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignatureEncoding
+	}
+
+	if !hmac.Equal(messageMAC, signatureFor(path, k)) {
+		return errInvalidSignature
+	}
+
+	return nil
+}
+
+// resignURL re-signs a URL we gave out earlier with the active key.
+// The old signature has to be valid, otherwise we'd sign whatever is asked.
+func resignURL(rawURL string) (string, error) {
+	if activeSignatureKey == nil {
+		return "", errors.New("Signing is disabled")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	// {base}/{signature}/{config}/{source}
+	p := strings.TrimPrefix(u.Path, "/")
+
+	sigEnd := strings.IndexByte(p, '/')
+	if sigEnd <= 0 {
+		return "", errInvalidSignature
+	}
+
+	signature, path := p[:sigEnd], p[sigEnd:]
+
+	if err := validatePath(signature, path); err != nil {
+		return "", err
+	}
+
+	u.Path = "/" + signPath(path)
+	u.RawPath = ""
+
+	return u.String(), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestValidatePath(t *testing.T) {
+	legacy := signatureKey{"", []byte("legacy-key"), []byte("legacy-salt")}
+	k1 := signatureKey{"k1", []byte("key-1"), []byte("salt-1")}
+	k2 := signatureKey{"k2", []byte("key-2"), []byte("salt-2")}
+
+	defer func(keys []signatureKey) { signatureKeys = keys }(signatureKeys)
+	signatureKeys = []signatureKey{legacy, k1, k2}
+
+	const path = "/w:100/h:100/image.jpg"
+
+	sign := func(k signatureKey) string {
+		return base64.RawURLEncoding.EncodeToString(signatureFor(path, k))
+	}
+
+	tests := []struct {
+		name      string
+		signature string
+		path      string
+		err       error
+	}{
+		{"keyed", "k1." + sign(k1), path, nil},
+		{"keyed with another key", "k2." + sign(k2), path, nil},
+		{"keyed with the wrong key", "k1." + sign(k2), path, errInvalidSignature},
+		{"keyed with another path", "k1." + sign(k1), "/w:200/h:200/image.jpg", errInvalidSignature},
+		{"legacy", sign(legacy), path, nil},
+		{"keyed signature without key id", sign(k2), path, errInvalidSignature},
+		{"empty key id is the legacy key", "." + sign(legacy), path, nil},
+		{"empty key id with a keyed signature", "." + sign(k1), path, errInvalidSignature},
+		{"unknown key id", "k3." + sign(k1), path, errUnknownSignatureKey},
+		{"bad base64", "k1.not*base64", path, errInvalidSignatureEncoding},
+		{"padded base64", "k1." + base64.URLEncoding.EncodeToString(signatureFor(path, k1)), path, errInvalidSignatureEncoding},
+		{"empty signature", "", path, errInvalidSignature},
+	}
+
+	noLegacy := []struct {
+		name      string
+		signature string
+		err       error
+	}{
+		{"keyed", "k1." + sign(k1), nil},
+		{"legacy", sign(legacy), errInvalidSignature},
+		{"keyed signature without key id", sign(k1), errInvalidSignature},
+		{"empty key id", "." + sign(legacy), errInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePath(tt.signature, tt.path); err != tt.err {
+				t.Errorf("validatePath(%q, %q) = %v, want %v", tt.signature, tt.path, err, tt.err)
+			}
+		})
+	}
+
+	signatureKeys = []signatureKey{k1, k2}
+
+	for _, tt := range noLegacy {
+		t.Run("without legacy key/"+tt.name, func(t *testing.T) {
+			if err := validatePath(tt.signature, path); err != tt.err {
+				t.Errorf("validatePath(%q) = %v, want %v", tt.signature, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSignPath(t *testing.T) {
+	k1 := signatureKey{"k1", []byte("key-1"), []byte("salt-1")}
+	legacy := signatureKey{"", []byte("legacy-key"), []byte("legacy-salt")}
+
+	defer func(keys []signatureKey, active *signatureKey) {
+		signatureKeys, activeSignatureKey = keys, active
+	}(signatureKeys, activeSignatureKey)
+	signatureKeys = []signatureKey{legacy, k1}
+
+	const path = "/w:100/image.jpg"
+
+	for _, k := range signatureKeys {
+		k := k
+		activeSignatureKey = &k
+
+		signed := signPath(path)
+		signature := signed[:len(signed)-len(path)]
+
+		if err := validatePath(signature, path); err != nil {
+			t.Errorf("signPath with key %q gave %q: %v", k.id, signed, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	downloadClient *http.Client
+
+	errSourceURLInvalid     = errors.New("Đường dẫn hình không hợp lệ")
+	errSourceURLUnreachable = errors.New("Không thể tải hình từ đường dẫn này")
+
+	errForbiddenSourceAddress = errors.New("source address is not allowed")
+
+	forbiddenNetworks = mustParseCIDRs(
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local, cloud metadata lives here
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"224.0.0.0/4",    // multicast
+		"240.0.0.0/4",    // reserved
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+		"ff00::/8",       // multicast
+	)
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+
+	return nets
+}
+
+func isForbiddenIP(ip net.IP) bool {
+	for _, n := range forbiddenNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSourceAddress runs right before connecting, after DNS resolution,
+// so a hostname resolving (or redirecting) to an internal address is blocked too
+func checkSourceAddress(network, address string, _ syscall.RawConn) error {
+	if config.Iris.AllowPrivateSources {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || isForbiddenIP(ip) {
+		return errForbiddenSourceAddress
+	}
+
+	return nil
+}
+
+func initDownloading() {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkSourceAddress,
+	}
+
+	transport := &http.Transport{
+		Proxy:               nil, // a proxy would make the address check useless
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        config.Iris.Concurrency,
+		MaxIdleConnsPerHost: config.Iris.Concurrency,
+		DisableCompression:  true,
+	}
+
+	if config.Iris.IgnoreSslVerification {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	timeout := config.Iris.DownloadTimeout
+	if timeout == 0 {
+		timeout = config.Iris.Timeout
+	}
+
+	downloadClient = &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("stopped after 5 redirects")
+			}
+			return checkSourceURL(req.URL)
+		},
+	}
+}
+
+func checkSourceURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errSourceURLInvalid
+	}
+
+	if len(u.Hostname()) == 0 {
+		return errSourceURLInvalid
+	}
+
+	return nil
+}
+
+// downloadImage starts downloading the source image. Returned reader fails
+// with errSourceFileTooBig as soon as it reads more than MaxFileSize.
+func downloadImage(sourceURL string) (body io.ReadCloser, size int64, err error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, 0, errSourceURLInvalid
+	}
+
+	if err = checkSourceURL(u); err != nil {
+		return nil, 0, err
+	}
+
+	if prometheusEnabled {
+		stop := startPrometheusDuration(prometheusDownloadDuration)
+
+		// The body is read after we return, so the timer stops when it's read or closed
+		defer func() {
+			if err != nil {
+				stop()
+			} else {
+				body = &timedReadCloser{ReadCloser: body, stop: stop}
+			}
+		}()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, errSourceURLInvalid
+	}
+	req.Header.Set("User-Agent", "iris")
+
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		log.Debugf("Can't download %s: %s", sourceURL, err)
+		if prometheusEnabled {
+			incrementPrometheusErrorsTotal("download")
+		}
+		return nil, 0, errSourceURLUnreachable
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		log.Debugf("Can't download %s: %s", sourceURL, res.Status)
+		if prometheusEnabled {
+			incrementPrometheusErrorsTotal("download")
+		}
+		return nil, 0, errSourceURLUnreachable
+	}
+
+	if res.ContentLength > config.Iris.MaxFileSize {
+		res.Body.Close()
+		return nil, 0, errSourceFileTooBig
+	}
+
+	size = res.ContentLength
+	if size < 0 {
+		size = 0
+	}
+
+	return &limitReader{r: res.Body, left: int(config.Iris.MaxFileSize)}, size, nil
+}
+
+// timedReadCloser calls stop once the reader is read to the end or closed.
+// The body is closed only after the upload is stored, EOF is when the download is done.
+type timedReadCloser struct {
+	io.ReadCloser
+	stop func()
+	once sync.Once
+}
+
+func (r *timedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		r.once.Do(r.stop)
+	}
+	return n, err
+}
+
+func (r *timedReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.stop)
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCheckSourceAddress(t *testing.T) {
+	defer func(allow bool) { config.Iris.AllowPrivateSources = allow }(config.Iris.AllowPrivateSources)
+	config.Iris.AllowPrivateSources = false
+
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"127.0.0.1:80", false},
+		{"127.1.2.3:443", false},
+		{"169.254.169.254:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"192.168.1.1:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[::]:80", false},
+		{"[fd00::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:169.254.169.254]:80", false},
+		{"[::ffff:10.0.0.1]:80", false},
+		{"localhost:80", false},
+		{"8.8.8.8:443", true},
+		{"172.32.0.1:80", true},
+		{"[2001:4860:4860::8888]:443", true},
+		{"[::ffff:8.8.8.8]:443", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := checkSourceAddress("tcp", tt.address, nil)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("checkSourceAddress(%q) = %v, want allowed %v", tt.address, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckSourceAddressAllowPrivate(t *testing.T) {
+	defer func(allow bool) { config.Iris.AllowPrivateSources = allow }(config.Iris.AllowPrivateSources)
+	config.Iris.AllowPrivateSources = true
+
+	for _, address := range []string{"127.0.0.1:80", "169.254.169.254:80", "[::ffff:10.0.0.1]:80"} {
+		if err := checkSourceAddress("tcp", address, nil); err != nil {
+			t.Errorf("checkSourceAddress(%q) = %v with allow_private_sources", address, err)
+		}
+	}
+}
+
+func TestTimedReadCloser(t *testing.T) {
+	stops := 0
+	r := &timedReadCloser{ReadCloser: ioutil.NopCloser(strings.NewReader("image")), stop: func() { stops++ }}
+
+	buf := make([]byte, 2)
+	if _, err := r.Read(buf); err != nil || stops != 0 {
+		t.Fatalf("Read() error = %v, stopped %d times before the end", err, stops)
+	}
+
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	if stops != 1 {
+		t.Errorf("stopped %d times, want once", stops)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"runtime"
 	"strings"
@@ -85,3 +86,95 @@ ERROR:
 		log.Debug(err)
 	}
 }
+
+type storageErrorKind int
+
+const (
+	storageErrorUnknown storageErrorKind = iota
+	storageErrorNotFound
+	storageErrorPermission
+	storageErrorQuota
+	storageErrorTimeout
+	storageErrorUnavailable
+)
+
+var storageErrorKindNames = map[storageErrorKind]string{
+	storageErrorUnknown:     "unknown",
+	storageErrorNotFound:    "not_found",
+	storageErrorPermission:  "permission",
+	storageErrorQuota:       "quota",
+	storageErrorTimeout:     "timeout",
+	storageErrorUnavailable: "unavailable",
+}
+
+// storageError describes a failed call to the storage backend.
+// StatusCode is the status returned by the storage transport, 0 if the call didn't get a response at all
+type storageError struct {
+	Kind       storageErrorKind
+	StatusCode int
+	Message    string
+}
+
+func (e *storageError) Error() string {
+	if e.StatusCode > 0 {
+		return fmt.Sprintf("Storage error (%s, %d): %s", e.Kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("Storage error (%s): %s", e.Kind, e.Message)
+}
+
+// HTTPStatus is the status we answer with when the storage fails
+func (e *storageError) HTTPStatus() int {
+	switch e.Kind {
+	case storageErrorNotFound:
+		return http.StatusNotFound
+	case storageErrorPermission:
+		return http.StatusInternalServerError
+	case storageErrorQuota:
+		return http.StatusInsufficientStorage
+	case storageErrorTimeout:
+		return http.StatusGatewayTimeout
+	case storageErrorUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (k storageErrorKind) String() string {
+	return storageErrorKindNames[k]
+}
+
+func newStorageStatusError(statusCode int, msg string) *storageError {
+	kind := storageErrorUnknown
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		kind = storageErrorNotFound
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		kind = storageErrorPermission
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusInsufficientStorage:
+		kind = storageErrorQuota
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		kind = storageErrorTimeout
+	case statusCode >= 500:
+		kind = storageErrorUnavailable
+	}
+
+	return &storageError{kind, statusCode, msg}
+}
+
+// newStorageTransportError wraps an error returned by storage client itself,
+// i.e. the backend didn't answer with any status
+func newStorageTransportError(err error) *storageError {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &storageError{storageErrorTimeout, 0, err.Error()}
+	}
+	return &storageError{storageErrorUnavailable, 0, err.Error()}
+}
+
+func newStorageHTTPError(err error) *echo.HTTPError {
+	if se, ok := err.(*storageError); ok {
+		return echo.NewHTTPError(se.HTTPStatus(), se.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fileTransport struct {
+	root string
+}
+
+func newFileTransport() http.RoundTripper {
+	root := config.Storage.File.Root
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		log.Fatalf("Can't create file storage root %s: %s", root, err)
+	}
+
+	return fileTransport{root}
+}
+
+func (t fileTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return t.readObject(req)
+	case http.MethodPut:
+		return t.writeObject(req)
+	case http.MethodDelete:
+		return t.deleteObject(req)
+	default:
+		return newStorageResponse(req, http.StatusMethodNotAllowed), nil
+	}
+}
+
+// objectPath maps file://bucket/object to root/bucket/object
+// without letting the object name escape the root
+func (t fileTransport) objectPath(req *http.Request) string {
+	name := filepath.FromSlash(strings.TrimPrefix(req.URL.Path, "/"))
+	return filepath.Join(t.root, req.URL.Host, filepath.Clean("/"+name))
+}
+
+func (t fileTransport) readObject(req *http.Request) (resp *http.Response, err error) {
+	f, err := os.Open(t.objectPath(req))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newStorageResponse(req, http.StatusNotFound), nil
+		}
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var body io.ReadCloser = f
+
+	if req.Method == http.MethodHead {
+		f.Close()
+		body = nil
+	}
+
+	// Same weak validator nginx uses: mtime and size
+	etag := fmt.Sprintf("%x-%x", stat.ModTime().Unix(), stat.Size())
+
+	return newStorageObjectResponse(req, body, stat.Size(), "", etag, stat.ModTime()), nil
+}
+
+func (t fileTransport) writeObject(req *http.Request) (resp *http.Response, err error) {
+	path := t.objectPath(req)
+	defer req.Body.Close()
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// Write to a temp file first so readers never see a partial object
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, req.Body); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
+
+func (t fileTransport) deleteObject(req *http.Request) (resp *http.Response, err error) {
+	if err = os.Remove(t.objectPath(req)); err != nil {
+		if os.IsNotExist(err) {
+			return newStorageResponse(req, http.StatusNotFound), nil
+		}
+		return nil, err
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 )
 
 type gcsTransport struct {
@@ -26,16 +28,37 @@ func newGCSTransport() http.RoundTripper {
 
 func (t gcsTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return t.readObject(req)
 	case http.MethodPut:
 		return t.writeObject(req)
 	case http.MethodDelete:
 		return t.deleteObject(req)
 	default:
-		// should never happens
-		return nil, err
+		return newStorageResponse(req, http.StatusMethodNotAllowed), nil
 	}
 }
 
+func (t gcsTransport) readObject(req *http.Request) (resp *http.Response, err error) {
+	bkt := t.client.Bucket(req.URL.Host)
+	obj := bkt.Object(strings.TrimPrefix(req.URL.Path, "/"))
+
+	attrs, err := obj.Attrs(req.Context())
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	var body io.ReadCloser
+
+	if req.Method == http.MethodGet {
+		if body, err = obj.NewReader(req.Context()); err != nil {
+			return t.errorResponse(req, err)
+		}
+	}
+
+	return newStorageObjectResponse(req, body, attrs.Size, attrs.ContentType, attrs.Etag, attrs.Updated), nil
+}
+
 func (t gcsTransport) writeObject(req *http.Request) (resp *http.Response, err error) {
 	bkt := t.client.Bucket(req.URL.Host)
 	obj := bkt.Object(strings.TrimPrefix(req.URL.Path, "/"))
@@ -49,40 +72,36 @@ func (t gcsTransport) writeObject(req *http.Request) (resp *http.Response, err e
 	ow.SendCRC32C = true
 
 	if _, err = ow.Write(data); err != nil {
-		return nil, err
+		return t.errorResponse(req, err)
 	}
 
 	if err := ow.Close(); err != nil {
-		return nil, err
+		return t.errorResponse(req, err)
 	}
 
-	return &http.Response{
-		Status:     "200 OK",
-		StatusCode: 200,
-		Proto:      "HTTP/1.0",
-		ProtoMajor: 1,
-		ProtoMinor: 0,
-		Header:     make(http.Header),
-		Close:      true,
-		Request:    req,
-	}, nil
+	return newStorageResponse(req, http.StatusOK), nil
 }
 
 func (t gcsTransport) deleteObject(req *http.Request) (resp *http.Response, err error) {
 	bkt := t.client.Bucket(req.URL.Host)
 	obj := bkt.Object(strings.TrimPrefix(req.URL.Path, "/"))
 	if err := obj.Delete(context.Background()); err != nil {
-		return nil, err
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
+
+// errorResponse turns GCS API errors into responses with the matching status,
+// so invokeStorageClient can tell a missing object from an unavailable backend
+func (t gcsTransport) errorResponse(req *http.Request, err error) (*http.Response, error) {
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return newStorageResponse(req, http.StatusNotFound), nil
+	}
+
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code > 0 {
+		return newStorageResponse(req, gerr.Code), nil
 	}
 
-	return &http.Response{
-		Status:     "200 OK",
-		StatusCode: 200,
-		Proto:      "HTTP/1.0",
-		ProtoMajor: 1,
-		ProtoMinor: 0,
-		Header:     make(http.Header),
-		Close:      true,
-		Request:    req,
-	}, nil
+	return nil, err
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"image"
 	"image/draw"
 
@@ -26,3 +27,30 @@ func icoData(data []byte) (out []byte, width int, height int, err error) {
 
 	return
 }
+
+// icoFromPNG wraps PNG data into a single image ICO container.
+// Sizes of 256 and more are written as 0, the PNG itself keeps the real ones.
+func icoFromPNG(png []byte, width, height int) []byte {
+	const headerSize = 6 + 16
+
+	dim := func(d int) uint8 {
+		if d >= 256 {
+			return 0
+		}
+		return uint8(d)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, headerSize+len(png)))
+
+	// ICONDIR: reserved, type (1 is icon), images count
+	binary.Write(buf, binary.LittleEndian, []uint16{0, 1, 1})
+
+	// ICONDIRENTRY
+	buf.Write([]byte{dim(width), dim(height), 0, 0})
+	binary.Write(buf, binary.LittleEndian, []uint16{1, 32})
+	binary.Write(buf, binary.LittleEndian, []uint32{uint32(len(png)), headerSize})
+
+	buf.Write(png)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Async uploads (?async=1) are checked like any upload, then answered with 202 and a job.
+// Workers run the rest of the chain, the job keeps its result for config.Iris.JobTTL.
+
+const (
+	jobStatusQueued     = "queued"
+	jobStatusProcessing = "processing"
+	jobStatusDone       = "done"
+	jobStatusFailed     = "failed"
+
+	jobResultKey = "jobResult"
+)
+
+var (
+	jobIDRegex = regexp.MustCompile("^[0-9a-f]{32}$")
+
+	jobsMutex sync.RWMutex
+	jobs      = make(map[string]*job)
+
+	jobQueue chan *job
+
+	// jobPipeline is the upload chain after the source is checked
+	jobPipeline echo.HandlerFunc
+)
+
+type job struct {
+	ID        string                 `json:"job_id"`
+	Status    string                 `json:"status"`
+	Result    map[string]interface{} `json:"result,omitempty"`
+	Error     interface{}            `json:"error,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+
+	c echo.Context
+}
+
+func initJobs() {
+	jobQueue = make(chan *job, config.Iris.JobQueueSize)
+	jobPipeline = process(genID(genObjectURL(storeJobResult)))
+
+	workers := config.Iris.JobWorkers
+	if workers <= 0 {
+		workers = config.Iris.Concurrency
+	}
+
+	for i := 0; i < workers; i++ {
+		go runJobs()
+	}
+
+	if config.Iris.JobTTL > 0 {
+		go func() {
+			for range time.Tick(config.Iris.JobTTL / 2) {
+				cleanExpiredJobs()
+			}
+		}()
+	}
+}
+
+func runJobs() {
+	for j := range jobQueue {
+		setJobStatus(j, jobStatusProcessing, nil, nil)
+
+		if err := jobPipeline(j.c); err != nil {
+			log.Errorf("Job %s failed: %s", j.ID, err)
+			setJobStatus(j, jobStatusFailed, nil, batchItemError(err))
+			continue
+		}
+
+		setJobStatus(j, jobStatusDone, j.c.Get(jobResultKey).(map[string]interface{}), nil)
+	}
+}
+
+func setJobStatus(j *job, status string, result map[string]interface{}, jobErr interface{}) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	j.Status = status
+	j.Result = result
+	j.Error = jobErr
+	j.UpdatedAt = time.Now()
+
+	// the context holds the source, no need to keep it around
+	if status == jobStatusDone || status == jobStatusFailed {
+		j.c = nil
+	}
+}
+
+func cleanExpiredJobs() {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for id, j := range jobs {
+		if (j.Status == jobStatusDone || j.Status == jobStatusFailed) && time.Since(j.UpdatedAt) > config.Iris.JobTTL {
+			delete(jobs, id)
+		}
+	}
+}
+
+func storeJobResult(c echo.Context) error {
+	res, err := storeImage(c)
+	if err != nil {
+		return err
+	}
+
+	c.Set(jobResultKey, res)
+	return nil
+}
+
+func isAsyncUpload(c echo.Context) bool {
+	async, _ := strconv.ParseBool(c.FormValue("async"))
+	return async
+}
+
+// enqueueUpload hands async uploads over to the job workers.
+// The source is copied since the request buffer goes back to the pool.
+func enqueueUpload(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isAsyncUpload(c) {
+			return next(c)
+		}
+
+		log.Debug("Start enqueueUpload")
+
+		rnd := make([]byte, 16)
+		if _, err := rand.Read(rnd); err != nil {
+			return err
+		}
+
+		// Nothing in the job pipeline reads the body or writes to the response
+		jc := e.NewContext(c.Request().WithContext(context.Background()), nil)
+		jc.SetParamNames(c.ParamNames()...)
+		jc.SetParamValues(c.ParamValues()...)
+		for _, key := range []string{startTimeKey, imageWidthKey, imageHeightKey, imageTypeKey, imageFileSizeKey, imageProcessingOptionsKey, imageMetadataKey} {
+			if v := c.Get(key); v != nil {
+				jc.Set(key, v)
+			}
+		}
+		jc.Set(imageDataBufferKey, bytes.NewBuffer(append([]byte(nil), c.Get(imageDataBufferKey).(*bytes.Buffer).Bytes()...)))
+
+		now := time.Now()
+		j := &job{
+			ID:        hex.EncodeToString(rnd),
+			Status:    jobStatusQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+			c:         jc,
+		}
+
+		jobsMutex.Lock()
+		jobs[j.ID] = j
+		jobsMutex.Unlock()
+
+		select {
+		case jobQueue <- j:
+		default:
+			jobsMutex.Lock()
+			delete(jobs, j.ID)
+			jobsMutex.Unlock()
+
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many pending jobs, try again later")
+		}
+
+		c.Response().Header().Set(echo.HeaderLocation, "/v1/1i/jobs/"+j.ID)
+
+		return c.JSON(http.StatusAccepted, jobView(j))
+	}
+}
+
+func getJob(c echo.Context) error {
+	id := c.Param("jobId")
+	if !jobIDRegex.MatchString(id) {
+		return echo.NewHTTPError(http.StatusNotFound, "Job not found")
+	}
+
+	jobsMutex.RLock()
+	j, ok := jobs[id]
+	jobsMutex.RUnlock()
+
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Job not found")
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	return c.JSON(http.StatusOK, jobView(j))
+}
+
+// jobView copies the job under the lock, workers keep updating it
+func jobView(j *job) job {
+	jobsMutex.RLock()
+	defer jobsMutex.RUnlock()
+
+	return job{
+		ID:        j.ID,
+		Status:    j.Status,
+		Result:    j.Result,
+		Error:     j.Error,
+		CreatedAt: j.CreatedAt,
+		UpdatedAt: j.UpdatedAt,
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// presets are named bundles of URL options defined in config.yaml, e.g. avatar: rs:fill:200:200/g:sm
+var presets = make(map[string]urlOptions)
+
+func initPresets() {
+	for name, value := range config.Presets {
+		if err := parsePreset(name, value); err != nil {
+			log.Fatalf("Invalid preset %s: %s", name, err)
+		}
+	}
+
+	log.Debugf("Presets: %+v", presets)
+}
+
+func parsePreset(name, value string) error {
+	if len(name) == 0 || strings.ContainsAny(name, ":,/") {
+		return fmt.Errorf("Invalid preset name: %q", name)
+	}
+
+	options, rest := parseURLOptions(strings.Split(strings.Trim(value, "/"), "/"))
+	if len(rest) > 0 {
+		return fmt.Errorf("Invalid preset value: %s", value)
+	}
+
+	for _, opt := range options {
+		if isPresetOption(opt.Name) {
+			return fmt.Errorf("Presets can't include other presets")
+		}
+	}
+
+	// Make sure the preset applies cleanly before anyone asks for it
+	if err := applyProcessingOptions(newProcessingOptions(), options); err != nil {
+		return err
+	}
+
+	presets[name] = options
+
+	return nil
+}
+
+// applyPresetOption applies the named presets in the given order, later ones win
+func applyPresetOption(po *processingOptions, args []string) error {
+	for _, name := range args {
+		preset, ok := presets[name]
+		if !ok {
+			return fmt.Errorf("Unknown preset: %s", name)
+		}
+
+		po.UsedPresets = append(po.UsedPresets, name)
+
+		if err := applyProcessingOptions(po, preset); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -10,6 +10,8 @@ import "C"
 import (
 	"context"
 	"errors"
+	"fmt"
+	"html"
 	"math"
 	"os"
 	"runtime"
@@ -21,12 +23,17 @@ import (
 
 var (
 	vipsSupportSmartcrop bool
+	vipsSupportText      bool
 	vipsTypeSupportLoad  = make(map[imageType]bool)
 	vipsTypeSupportSave  = make(map[imageType]bool)
 
 	watermark *C.VipsImage
 
+	// namedWatermarks are the watermarks config, guarded by watermarksMutex
+	namedWatermarks = make(map[string]*C.VipsImage)
+
 	errSmartCropNotSupported = errors.New("Smart crop is not supported by used version of libvips")
+	errTextNotSupported      = errors.New("Text watermarks are not supported by used libvips, it's built without pango")
 )
 
 type cConfig struct {
@@ -64,6 +71,7 @@ func initVips() {
 	}
 
 	vipsSupportSmartcrop = C.vips_support_smartcrop() == 1
+	vipsSupportText = C.vips_support_text() == 1
 
 	if int(C.vips_type_find_load_go(C.int(imageTypeJPEG))) != 0 {
 		vipsTypeSupportLoad[imageTypeJPEG] = true
@@ -110,15 +118,14 @@ func initVips() {
 
 	cConf.WatermarkOpacity = C.double(config.Image.WatermarkOpacity)
 
-	if err := vipsPrepareWatermark(); err != nil {
-		log.Fatal(err.Error())
-	}
-
 	collectVipsMetrics()
 }
 
 func shutdownVips() {
 	C.clear_image(&watermark)
+	for _, wm := range namedWatermarks {
+		C.clear_image(&wm)
+	}
 	C.vips_shutdown()
 }
 
@@ -422,6 +429,7 @@ func transformImage(ctx context.Context, img **C.VipsImage, data []byte, po *pro
 	return vipsFixColourspace(img)
 }
 
+// transformGif transforms every frame of an animated GIF or WebP, up to config.Image.MaxGifFrames
 func transformGif(ctx context.Context, img **C.VipsImage, po *processingOptions) error {
 	imgWidth := int((*img).Xsize)
 	imgHeight := int((*img).Ysize)
@@ -436,18 +444,25 @@ func transformGif(ctx context.Context, img **C.VipsImage, po *processingOptions)
 		return err
 	}
 
-	delay, err := vipsGetInt(*img, "gif-delay")
+	// WebP has only the delay array and loop on older libvips
+	delay, err := vipsGetIntDefault(*img, "gif-delay", 10)
 	if err != nil {
 		return err
 	}
 
-	loop, err := vipsGetInt(*img, "gif-loop")
+	loop, err := vipsGetIntDefault(*img, "gif-loop", 0)
 	if err != nil {
 		return err
 	}
 
+	if loop, err = vipsGetIntDefault(*img, "loop", loop); err != nil {
+		return err
+	}
+
 	framesCount := minInt(imgHeight/frameHeight, config.Image.MaxGifFrames)
 
+	delays := vipsGetDelay(*img, framesCount, delay)
+
 	frames := make([]*C.VipsImage, framesCount)
 	defer func() {
 		for _, frame := range frames {
@@ -484,14 +499,24 @@ func transformGif(ctx context.Context, img **C.VipsImage, po *processingOptions)
 		return err
 	}
 
+	// gifsave and webpsave make an animation of the pages, webpsave reads delay and loop
 	vipsSetInt(*img, "page-height", int(frames[0].Ysize))
 	vipsSetInt(*img, "gif-delay", delay)
 	vipsSetInt(*img, "gif-loop", loop)
+	vipsSetInt(*img, "loop", loop)
+	vipsSetDelay(*img, delays)
 
 	return nil
 }
 
 func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
+	data, _, cancel, err := processImageRenditions(ctx, nil)
+	return data, cancel, err
+}
+
+// processImageRenditions decodes the source once and produces the image and a rendition per processing options.
+// Renditions are always static, animated GIFs give their first frame.
+func processImageRenditions(ctx context.Context, pos []*processingOptions) ([]byte, []processedImage, context.CancelFunc, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
@@ -505,44 +530,148 @@ func processImage(ctx context.Context) ([]byte, context.CancelFunc, error) {
 	data := getImageDataBuffer(ctx).Bytes()
 	imgtype := getImageType(ctx)
 
-	if po.Gravity.Type == gravitySmart && !vipsSupportSmartcrop {
-		return nil, func() {}, errSmartCropNotSupported
+	var cancels []context.CancelFunc
+	cancel := func() {
+		for _, c := range cancels {
+			c()
+		}
 	}
 
-	if po.Format == imageTypeUnknown {
-		if vipsTypeSupportSave[imgtype] {
-			po.Format = imgtype
-		} else {
-			po.Format = imageTypeJPEG
+	for _, p := range append([]*processingOptions{po}, pos...) {
+		if p.Gravity.Type == gravitySmart && !vipsSupportSmartcrop {
+			return nil, nil, cancel, errSmartCropNotSupported
+		}
+
+		if p.Format == imageTypeUnknown {
+			if vipsTypeSupportSave[imgtype] {
+				p.Format = imgtype
+			} else {
+				p.Format = imageTypeJPEG
+			}
 		}
 	}
 
-	img, err := vipsLoadImage(data, imgtype, 1, 1.0, po.Format == imageTypeGIF)
+	src, err := vipsLoadImage(data, imgtype, 1, 1.0, supportsAnimation(po.Format))
 	if err != nil {
-		return nil, func() {}, err
+		return nil, nil, cancel, err
+	}
+	defer C.clear_image(&src)
+
+	animated := (imgtype == imageTypeGIF || imgtype == imageTypeWEBP) && supportsAnimation(po.Format) && vipsIsAnimated(src)
+
+	srcData := data
+	if len(pos) > 0 {
+		// Shrink on load as much as the biggest output allows, the source is decoded once for all of them
+		if !animated {
+			width, height, _, _ := extractMeta(src)
+
+			scale := calcScale(width, height, po, imgtype)
+			for _, p := range pos {
+				scale = math.Max(scale, calcScale(width, height, p, imgtype))
+			}
+
+			if shrink := calcShink(scale, imgtype); scale < 1.0 && shrink != 1 {
+				tmp, err := vipsLoadImage(data, imgtype, shrink, 1.0, false)
+				if err != nil {
+					return nil, nil, cancel, err
+				}
+				C.swap_and_clear(&src, tmp)
+			}
+		}
+
+		// Sequential access allows to read the image once, so keep it in memory for every output
+		if err = vipsImageCopyMemory(&src); err != nil {
+			return nil, nil, cancel, err
+		}
+		srcData = nil
+	}
+
+	var img *C.VipsImage
+	if C.vips_copy_go(src, &img) != 0 {
+		return nil, nil, cancel, vipsError()
 	}
 	defer C.clear_image(&img)
 
-	if imgtype == imageTypeGIF && po.Format == imageTypeGIF && vipsIsAnimatedGif(img) {
+	if animated {
 		if err := transformGif(ctx, &img, po); err != nil {
-			return nil, func() {}, err
+			return nil, nil, cancel, err
 		}
 	} else {
-		if err := transformImage(ctx, &img, data, po, imgtype); err != nil {
-			return nil, func() {}, err
+		if err := transformImage(ctx, &img, srcData, po, imgtype); err != nil {
+			return nil, nil, cancel, err
+		}
+	}
+
+	if po.Format == imageTypeGIF {
+		if err := vipsCastUchar(&img); err != nil {
+			return nil, nil, cancel, err
+		}
+	}
+
+	b, c, err := vipsSaveImage(img, po.Format, po.Quality)
+	cancels = append(cancels, c)
+	if err != nil || len(pos) == 0 {
+		return b, nil, cancel, err
+	}
+
+	if vipsIsAnimated(src) {
+		var frame *C.VipsImage
+
+		frameHeight, err := vipsGetInt(src, "page-height")
+		if err != nil {
+			return nil, nil, cancel, err
 		}
+
+		if err := vipsExtract(src, &frame, 0, 0, int(src.Xsize), frameHeight); err != nil {
+			return nil, nil, cancel, err
+		}
+
+		C.swap_and_clear(&src, frame)
+	}
+
+	results := make([]processedImage, len(pos))
+
+	for i, p := range pos {
+		rb, width, height, c, err := processRendition(ctx, src, imgtype, p)
+		cancels = append(cancels, c)
+		if err != nil {
+			return nil, nil, cancel, err
+		}
+
+		results[i] = processedImage{rb, width, height}
+	}
+
+	return b, results, cancel, nil
+}
+
+func processRendition(ctx context.Context, src *C.VipsImage, imgtype imageType, po *processingOptions) ([]byte, int, int, context.CancelFunc, error) {
+	var img *C.VipsImage
+
+	if C.vips_copy_go(src, &img) != 0 {
+		return nil, 0, 0, func() {}, vipsError()
+	}
+	defer C.clear_image(&img)
+
+	// No source data here, so no shrink-on-load: we've already decoded it
+	if err := transformImage(ctx, &img, nil, po, imgtype); err != nil {
+		return nil, 0, 0, func() {}, err
 	}
 
 	if po.Format == imageTypeGIF {
 		if err := vipsCastUchar(&img); err != nil {
-			return nil, func() {}, err
+			return nil, 0, 0, func() {}, err
 		}
 	}
 
-	return vipsSaveImage(img, po.Format, po.Quality)
+	b, cancel, err := vipsSaveImage(img, po.Format, po.Quality)
+
+	return b, int(img.Xsize), int(img.Ysize), cancel, err
 }
 
 func vipsPrepareWatermark() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
 	data, imgtype, cancel, err := watermarkData()
 	defer cancel()
 
@@ -554,26 +683,131 @@ func vipsPrepareWatermark() error {
 		return nil
 	}
 
-	watermark, err = vipsLoadImage(data, imgtype, 1, 1.0, false)
+	watermark, err = vipsLoadWatermark(data, imgtype, config.Image.WatermarkOpacity)
+
+	return err
+}
+
+// vipsLoadWatermark loads the watermark into memory with the opacity applied.
+// It always gets an alpha channel, vips_apply_watermark relies on it.
+func vipsLoadWatermark(data []byte, imgtype imageType, opacity float64) (*C.VipsImage, error) {
+	img, err := vipsLoadImage(data, imgtype, 1, 1.0, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var tmp *C.VipsImage
 
-	if C.vips_apply_opacity(watermark, &tmp, C.double(config.Image.WatermarkOpacity)) != 0 {
-		return vipsError()
+	if C.vips_apply_opacity(img, &tmp, C.double(opacity)) != 0 {
+		C.clear_image(&img)
+		return nil, vipsError()
 	}
-	C.swap_and_clear(&watermark, tmp)
+	C.swap_and_clear(&img, tmp)
 
-	if tmp = C.vips_image_copy_memory(watermark); tmp == nil {
-		return vipsError()
+	if tmp = C.vips_image_copy_memory(img); tmp == nil {
+		C.clear_image(&img)
+		return nil, vipsError()
 	}
-	C.swap_and_clear(&watermark, tmp)
+	C.swap_and_clear(&img, tmp)
+
+	return img, nil
+}
+
+// vipsLoadWatermarks replaces the named watermarks. All of them are loaded before the swap,
+// so a broken config keeps the current ones. Images being processed hold their own references.
+func vipsLoadWatermarks(conf map[string]watermarkConfig) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	images := make(map[string]*C.VipsImage, len(conf))
+	options := make(map[string]watermarkOptions, len(conf))
+
+	clearImages := func(images map[string]*C.VipsImage) {
+		for _, img := range images {
+			C.clear_image(&img)
+		}
+	}
+
+	for name, wc := range conf {
+		opts, err := parseWatermarkConfig(name, wc)
+		if err != nil {
+			clearImages(images)
+			return err
+		}
+
+		data, imgtype, err := loadWatermarkSource(wc.Data, wc.Path, wc.Object)
+		if err == nil && data == nil {
+			err = errors.New("no source is set")
+		}
+		if err != nil {
+			clearImages(images)
+			return fmt.Errorf("Watermark %s: %s", name, err)
+		}
+
+		img, err := vipsLoadWatermark(data, imgtype, 1)
+		if err != nil {
+			clearImages(images)
+			return fmt.Errorf("Watermark %s: %s", name, err)
+		}
+
+		images[name] = img
+		options[name] = opts
+	}
+
+	watermarksMutex.Lock()
+	old := namedWatermarks
+	namedWatermarks = images
+	watermarkPresets = options
+	watermarksMutex.Unlock()
+
+	clearImages(old)
 
 	return nil
 }
 
+// vipsWatermarkText renders the text in the ink colour with an alpha channel,
+// so it's blended like any logo. Font size is in pixels.
+func vipsWatermarkText(opts *watermarkOptions) (*C.VipsImage, error) {
+	text := C.CString(html.EscapeString(opts.Text))
+	defer C.free(unsafe.Pointer(text))
+
+	font := C.CString(fmt.Sprintf("%s %d", opts.Font, opts.FontSize))
+	defer C.free(unsafe.Pointer(font))
+
+	var wm *C.VipsImage
+	if C.vips_text_go(&wm, text, font, 72, C.double(opts.Color.R), C.double(opts.Color.G), C.double(opts.Color.B)) != 0 {
+		return nil, vipsError()
+	}
+
+	return wm, nil
+}
+
+// vipsWatermarkCopy returns a new reference to the watermark, the registry can be reloaded meanwhile
+func vipsWatermarkCopy(opts *watermarkOptions) (*C.VipsImage, error) {
+	if len(opts.Text) > 0 {
+		return vipsWatermarkText(opts)
+	}
+
+	watermarksMutex.RLock()
+	defer watermarksMutex.RUnlock()
+
+	src := watermark
+	if len(opts.Name) > 0 {
+		src = namedWatermarks[opts.Name]
+	}
+
+	if src == nil {
+		return nil, nil
+	}
+
+	var wm *C.VipsImage
+	if C.vips_copy_go(src, &wm) != 0 {
+		return nil, vipsError()
+	}
+
+	return wm, nil
+}
+
 func vipsLoadImage(data []byte, imgtype imageType, shrink int, svgScale float64, allPages bool) (*C.VipsImage, error) {
 	var img *C.VipsImage
 
@@ -590,7 +824,7 @@ func vipsLoadImage(data []byte, imgtype imageType, shrink int, svgScale float64,
 	case imageTypePNG:
 		err = C.vips_pngload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), &img)
 	case imageTypeWEBP:
-		err = C.vips_webpload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(shrink), &img)
+		err = C.vips_webpload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), C.int(shrink), pages, &img)
 	case imageTypeGIF:
 		err = C.vips_gifload_go(unsafe.Pointer(&data[0]), C.size_t(len(data)), pages, &img)
 	case imageTypeSVG:
@@ -635,7 +869,7 @@ func vipsSaveImage(img *C.VipsImage, imgtype imageType, quality int) ([]byte, co
 	case imageTypeGIF:
 		err = C.vips_gifsave_go(img, &ptr, &imgsize)
 	case imageTypeICO:
-		err = C.vips_icosave_go(img, &ptr, &imgsize)
+		err = C.vips_pngsave_go(img, &ptr, &imgsize, 0, 0)
 	}
 	if err != 0 {
 		C.g_free_go(&ptr)
@@ -646,6 +880,10 @@ func vipsSaveImage(img *C.VipsImage, imgtype imageType, quality int) ([]byte, co
 
 	b := (*[maxBufSize]byte)(ptr)[:int(imgsize):int(imgsize)]
 
+	if imgtype == imageTypeICO {
+		b = icoFromPNG(b, int(img.Xsize), int(img.Ysize))
+	}
+
 	return b, cancel, nil
 }
 
@@ -660,8 +898,46 @@ func vipsArrayjoin(in []*C.VipsImage, out **C.VipsImage) error {
 	return nil
 }
 
-func vipsIsAnimatedGif(img *C.VipsImage) bool {
-	return C.vips_is_animated_gif(img) > 0
+// supportsAnimation reports whether the format is saved with all the frames
+func supportsAnimation(imgtype imageType) bool {
+	return imgtype == imageTypeGIF || imgtype == imageTypeWEBP
+}
+
+// vipsGetDelay returns the frame delays in ms. Older libvips have gif-delay (in cs) only.
+func vipsGetDelay(img *C.VipsImage, framesCount int, gifDelay int) []int {
+	var (
+		ptr *C.int
+		n   C.int
+	)
+
+	delays := make([]int, framesCount)
+
+	if C.vips_get_delay_go(img, &ptr, &n) == 0 && n > 0 {
+		src := (*[1 << 20]C.int)(unsafe.Pointer(ptr))[:int(n):int(n)]
+		for i := range delays {
+			delays[i] = int(src[minInt(i, int(n)-1)])
+		}
+		return delays
+	}
+
+	for i := range delays {
+		delays[i] = gifDelay * 10
+	}
+
+	return delays
+}
+
+func vipsSetDelay(img *C.VipsImage, delays []int) {
+	cdelays := make([]C.int, len(delays))
+	for i, d := range delays {
+		cdelays[i] = C.int(d)
+	}
+
+	C.vips_set_delay_go(img, &cdelays[0], C.int(len(cdelays)))
+}
+
+func vipsIsAnimated(img *C.VipsImage) bool {
+	return C.vips_is_animated(img) > 0
 }
 
 func vipsImageHasAlpha(img *C.VipsImage) bool {
@@ -677,6 +953,14 @@ func vipsGetInt(img *C.VipsImage, name string) (int, error) {
 	return int(i), nil
 }
 
+// vipsGetIntDefault is for the fields only some loaders set, like gif-delay
+func vipsGetIntDefault(img *C.VipsImage, name string, def int) (int, error) {
+	if C.vips_image_has_field_go(img, cachedCString(name)) == 0 {
+		return def, nil
+	}
+	return vipsGetInt(img, name)
+}
+
 func vipsSetInt(img *C.VipsImage, name string, value int) {
 	C.vips_image_set_int(img, cachedCString(name), C.int(value))
 }
@@ -902,9 +1186,9 @@ func vipsEmbed(img **C.VipsImage, gravity gravityType, width, height C.int, offX
 	return nil
 }
 
-func vipsResizeWatermark(width, height int) (wm *C.VipsImage, err error) {
-	wmW := float64(watermark.Xsize)
-	wmH := float64(watermark.Ysize)
+func vipsResizeWatermark(wm **C.VipsImage, width, height int) error {
+	wmW := float64((*wm).Xsize)
+	wmH := float64((*wm).Ysize)
 
 	wr := float64(width) / wmW
 	hr := float64(height) / wmH
@@ -919,35 +1203,36 @@ func vipsResizeWatermark(width, height int) (wm *C.VipsImage, err error) {
 		scale = 1 / wmH
 	}
 
-	if C.vips_resize_with_premultiply(watermark, &wm, C.double(scale)) != 0 {
-		err = vipsError()
+	var tmp *C.VipsImage
+
+	if C.vips_resize_with_premultiply(*wm, &tmp, C.double(scale)) != 0 {
+		return vipsError()
 	}
+	C.swap_and_clear(wm, tmp)
 
-	return
+	return nil
 }
 
 func vipsApplyWatermark(img **C.VipsImage, opts *watermarkOptions) error {
-	if watermark == nil {
+	wm, err := vipsWatermarkCopy(opts)
+	if err != nil {
+		return err
+	}
+	if wm == nil {
 		return nil
 	}
-
-	var wm, tmp *C.VipsImage
 	defer C.clear_image(&wm)
 
-	var err error
+	var tmp *C.VipsImage
 
 	imgW := (*img).Xsize
 	imgH := (*img).Ysize
 
-	if opts.Scale == 0 {
-		if C.vips_copy_go(watermark, &wm) != 0 {
-			return vipsError()
-		}
-	} else {
+	if opts.Scale > 0 {
 		wmW := maxInt(int(float64(imgW)*opts.Scale), 1)
 		wmH := maxInt(int(float64(imgH)*opts.Scale), 1)
 
-		if wm, err = vipsResizeWatermark(wmW, wmH); err != nil {
+		if err = vipsResizeWatermark(&wm, wmW, wmH); err != nil {
 			return err
 		}
 	}
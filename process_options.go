@@ -7,11 +7,21 @@ package main
 import "C"
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
-type urlOptions map[string][]string
+type urlOption struct {
+	Name string
+	Args []string
+}
+
+// urlOptions keep the path order, options are applied left to right
+type urlOptions []urlOption
 
 type imageType int
 
@@ -25,6 +35,14 @@ const (
 	imageTypeSVG     = imageType(C.SVG)
 )
 
+var mimes = map[imageType]string{
+	imageTypeJPEG: "image/jpeg",
+	imageTypePNG:  "image/png",
+	imageTypeWEBP: "image/webp",
+	imageTypeGIF:  "image/gif",
+	imageTypeICO:  "image/x-icon",
+}
+
 type processingHeaders struct {
 	Accept        string
 	Width         string
@@ -100,7 +118,13 @@ const (
 	hexColorShortFormat = "%1x%1x%1x"
 )
 
+const (
+	watermarkTextMaxLen      = 256
+	watermarkTextMaxFontSize = 512
+)
+
 type watermarkOptions struct {
+	Name      string
 	Enabled   bool
 	Opacity   float64
 	Replicate bool
@@ -108,6 +132,11 @@ type watermarkOptions struct {
 	OffsetX   int
 	OffsetY   int
 	Scale     float64
+
+	Text     string
+	Font     string
+	FontSize int
+	Color    rgbColor
 }
 
 type processingOptions struct {
@@ -177,3 +206,568 @@ func colorFromHex(hexcolor string) (rgbColor, error) {
 
 	return c, nil
 }
+
+func newProcessingOptions() *processingOptions {
+	po := *defaultOption
+	po.UsedPresets = make([]string, 0)
+	return &po
+}
+
+func parseBoolOption(str string) bool {
+	b, err := strconv.ParseBool(str)
+
+	if err != nil {
+		log.Warnf("%s is not a valid boolean value. Treated as false", str)
+	}
+
+	return b
+}
+
+func isGravityOffcetValid(gravity gravityType, offset float64) bool {
+	if gravity == gravityCenter {
+		return true
+	}
+
+	return offset >= 0 && (gravity != gravityFocusPoint || offset <= 1)
+}
+
+func parseDimension(d *int, name, arg string) error {
+	if v, err := strconv.Atoi(arg); err == nil && v >= 0 {
+		*d = v
+	} else {
+		return fmt.Errorf("Invalid %s: %s", name, arg)
+	}
+
+	return nil
+}
+
+func parseFloatOption(f *float32, name, arg string) error {
+	if v, err := strconv.ParseFloat(arg, 32); err == nil && v >= 0 {
+		*f = float32(v)
+	} else {
+		return fmt.Errorf("Invalid %s: %s", name, arg)
+	}
+
+	return nil
+}
+
+func applyWidthOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid width arguments: %v", args)
+	}
+
+	return parseDimension(&po.Width, "width", args[0])
+}
+
+func applyHeightOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid height arguments: %v", args)
+	}
+
+	return parseDimension(&po.Height, "height", args[0])
+}
+
+func applyEnlargeOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid enlarge arguments: %v", args)
+	}
+
+	po.Enlarge = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyExpandOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid expand arguments: %v", args)
+	}
+
+	po.Expand = parseBoolOption(args[0])
+
+	return nil
+}
+
+func applyResizingTypeOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid resizing type arguments: %v", args)
+	}
+
+	if r, ok := resizeTypes[args[0]]; ok {
+		po.Resize = r
+	} else {
+		return fmt.Errorf("Invalid resize type: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyResizeOption(po *processingOptions, args []string) error {
+	if len(args) > 5 {
+		return fmt.Errorf("Invalid resize arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if err := applyResizingTypeOption(po, args[0:1]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if err := applyWidthOption(po, args[1:2]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if err := applyHeightOption(po, args[2:3]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		if err := applyEnlargeOption(po, args[3:4]); err != nil {
+			return err
+		}
+	}
+
+	if len(args) > 4 && len(args[4]) > 0 {
+		if err := applyExpandOption(po, args[4:5]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyDprOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid dpr arguments: %v", args)
+	}
+
+	if d, err := strconv.ParseFloat(args[0], 64); err == nil && d > 0 {
+		po.Dpr = d
+	} else {
+		return fmt.Errorf("Invalid dpr: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyGravityOption(po *processingOptions, args []string) error {
+	if g, ok := gravityTypes[args[0]]; ok {
+		po.Gravity.Type = g
+	} else {
+		return fmt.Errorf("Invalid gravity: %s", args[0])
+	}
+
+	if po.Gravity.Type == gravityFocusPoint {
+		if len(args) != 3 {
+			return fmt.Errorf("Invalid gravity arguments: %v", args)
+		}
+
+		if x, err := strconv.ParseFloat(args[1], 64); err == nil && isGravityOffcetValid(po.Gravity.Type, x) {
+			po.Gravity.X = x
+		} else {
+			return fmt.Errorf("Invalid gravity X: %s", args[1])
+		}
+
+		if y, err := strconv.ParseFloat(args[2], 64); err == nil && isGravityOffcetValid(po.Gravity.Type, y) {
+			po.Gravity.Y = y
+		} else {
+			return fmt.Errorf("Invalid gravity Y: %s", args[2])
+		}
+	} else if len(args) > 1 {
+		return fmt.Errorf("Invalid gravity arguments: %v", args)
+	}
+
+	return nil
+}
+
+func applyQualityOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid quality arguments: %v", args)
+	}
+
+	if q, err := strconv.Atoi(args[0]); err == nil && q > 0 && q <= 100 {
+		po.Quality = q
+	} else {
+		return fmt.Errorf("Invalid quality: %s", args[0])
+	}
+
+	return nil
+}
+
+func applyBackgroundOption(po *processingOptions, args []string) error {
+	switch len(args) {
+	case 1:
+		if len(args[0]) == 0 {
+			po.Flatten = false
+		} else if c, err := colorFromHex(args[0]); err == nil {
+			po.Flatten = true
+			po.Background = c
+		} else {
+			return fmt.Errorf("Invalid background argument: %s", err)
+		}
+
+	case 3:
+		po.Flatten = true
+
+		if r, err := strconv.ParseUint(args[0], 10, 8); err == nil && r <= 255 {
+			po.Background.R = uint8(r)
+		} else {
+			return fmt.Errorf("Invalid background red channel: %s", args[0])
+		}
+
+		if g, err := strconv.ParseUint(args[1], 10, 8); err == nil && g <= 255 {
+			po.Background.G = uint8(g)
+		} else {
+			return fmt.Errorf("Invalid background green channel: %s", args[1])
+		}
+
+		if b, err := strconv.ParseUint(args[2], 10, 8); err == nil && b <= 255 {
+			po.Background.B = uint8(b)
+		} else {
+			return fmt.Errorf("Invalid background blue channel: %s", args[2])
+		}
+
+	default:
+		return fmt.Errorf("Invalid background arguments: %v", args)
+	}
+
+	return nil
+}
+
+func applyBlurOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid blur arguments: %v", args)
+	}
+
+	return parseFloatOption(&po.Blur, "blur", args[0])
+}
+
+func applySharpenOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid sharpen arguments: %v", args)
+	}
+
+	return parseFloatOption(&po.Sharpen, "sharpen", args[0])
+}
+
+func applyWatermarkOption(po *processingOptions, args []string) error {
+	if len(args) > 5 {
+		return fmt.Errorf("Invalid watermark arguments: %v", args)
+	}
+
+	if o, err := strconv.ParseFloat(args[0], 64); err == nil && o >= 0 && o <= 1 {
+		po.Watermark.Enabled = o > 0
+		po.Watermark.Opacity = o
+	} else {
+		return fmt.Errorf("Invalid watermark opacity: %s", args[0])
+	}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		if args[1] == "re" {
+			po.Watermark.Replicate = true
+		} else if g, ok := gravityTypes[args[1]]; ok && g != gravityFocusPoint && g != gravitySmart {
+			po.Watermark.Gravity = g
+		} else {
+			return fmt.Errorf("Invalid watermark position: %s", args[1])
+		}
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if x, err := strconv.Atoi(args[2]); err == nil {
+			po.Watermark.OffsetX = x
+		} else {
+			return fmt.Errorf("Invalid watermark X offset: %s", args[2])
+		}
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		if y, err := strconv.Atoi(args[3]); err == nil {
+			po.Watermark.OffsetY = y
+		} else {
+			return fmt.Errorf("Invalid watermark Y offset: %s", args[3])
+		}
+	}
+
+	if len(args) > 4 && len(args[4]) > 0 {
+		if wmScale, err := strconv.ParseFloat(args[4], 64); err == nil && wmScale >= 0 {
+			po.Watermark.Scale = wmScale
+		} else {
+			return fmt.Errorf("Invalid watermark scale: %s", args[4])
+		}
+	}
+
+	return nil
+}
+
+// applyWatermarkNameOption picks a named watermark with its defaults, wm can override them afterwards
+func applyWatermarkNameOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid watermark name arguments: %v", args)
+	}
+
+	watermarksMutex.RLock()
+	opts, ok := watermarkPresets[args[0]]
+	watermarksMutex.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("Unknown watermark: %s", args[0])
+	}
+
+	// a text watermark keeps its text, the named one gives the placement only
+	if len(po.Watermark.Text) > 0 {
+		opts.Text = po.Watermark.Text
+		opts.Font = po.Watermark.Font
+		opts.FontSize = po.Watermark.FontSize
+		opts.Color = po.Watermark.Color
+	}
+
+	po.Watermark = opts
+
+	return nil
+}
+
+// applyWatermarkTextOption renders text instead of the logo: wmt:%base64url_text:%font:%size:%hex_color.
+// Opacity, position, offsets and scale still come from wm.
+func applyWatermarkTextOption(po *processingOptions, args []string) error {
+	if !vipsSupportText {
+		return errTextNotSupported
+	}
+
+	if len(args) > 4 {
+		return fmt.Errorf("Invalid watermark text arguments: %v", args)
+	}
+
+	text, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(args[0], "="))
+	if err != nil || len(text) == 0 || len(text) > watermarkTextMaxLen {
+		return fmt.Errorf("Invalid watermark text: %s", args[0])
+	}
+
+	po.Watermark.Enabled = true
+	po.Watermark.Text = string(text)
+	po.Watermark.Font = "sans"
+	po.Watermark.FontSize = 24
+	po.Watermark.Color = rgbColor{255, 255, 255}
+
+	if len(args) > 1 && len(args[1]) > 0 {
+		po.Watermark.Font = args[1]
+	}
+
+	if len(args) > 2 && len(args[2]) > 0 {
+		if size, err := strconv.Atoi(args[2]); err == nil && size > 0 && size <= watermarkTextMaxFontSize {
+			po.Watermark.FontSize = size
+		} else {
+			return fmt.Errorf("Invalid watermark font size: %s", args[2])
+		}
+	}
+
+	if len(args) > 3 && len(args[3]) > 0 {
+		c, err := colorFromHex(args[3])
+		if err != nil {
+			return fmt.Errorf("Invalid watermark color: %s", err)
+		}
+		po.Watermark.Color = c
+	}
+
+	return nil
+}
+
+func applyFormatOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid format arguments: %v", args)
+	}
+
+	if f, ok := imageTypes[args[0]]; ok {
+		po.Format = f
+	} else {
+		return fmt.Errorf("Invalid image format: %s", args[0])
+	}
+
+	if !vipsTypeSupportSave[po.Format] {
+		return fmt.Errorf("Resulting image format is not supported: %s", po.Format)
+	}
+
+	return nil
+}
+
+func applyProcessingOption(po *processingOptions, name string, args []string) error {
+	switch name {
+	case "resize", "rs":
+		return applyResizeOption(po, args)
+	case "resizing_type", "rt":
+		return applyResizingTypeOption(po, args)
+	case "width", "w":
+		return applyWidthOption(po, args)
+	case "height", "h":
+		return applyHeightOption(po, args)
+	case "dpr":
+		return applyDprOption(po, args)
+	case "enlarge", "el":
+		return applyEnlargeOption(po, args)
+	case "extend", "expand", "ex":
+		return applyExpandOption(po, args)
+	case "gravity", "g":
+		return applyGravityOption(po, args)
+	case "quality", "q":
+		return applyQualityOption(po, args)
+	case "background", "bg":
+		return applyBackgroundOption(po, args)
+	case "blur", "bl":
+		return applyBlurOption(po, args)
+	case "sharpen", "sh":
+		return applySharpenOption(po, args)
+	case "watermark", "wm":
+		return applyWatermarkOption(po, args)
+	case "watermark_name", "wmn":
+		return applyWatermarkNameOption(po, args)
+	case "watermark_text", "wmt":
+		return applyWatermarkTextOption(po, args)
+	case "format", "f", "ext":
+		return applyFormatOption(po, args)
+	case "preset", "pr":
+		return applyPresetOption(po, args)
+	}
+
+	return fmt.Errorf("Unknown processing option %s", name)
+}
+
+func isPresetOption(name string) bool {
+	return name == "preset" || name == "pr"
+}
+
+func isWatermarkNameOption(name string) bool {
+	return name == "watermark_name" || name == "wmn"
+}
+
+func applyProcessingOptions(po *processingOptions, options urlOptions) error {
+	// Presets go first so the explicit options override them
+	for _, opt := range options {
+		if isPresetOption(opt.Name) {
+			if err := applyPresetOption(po, opt.Args); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The named watermark gives the defaults, wm and wmt override them wherever they are
+	for _, opt := range options {
+		if isWatermarkNameOption(opt.Name) {
+			if err := applyWatermarkNameOption(po, opt.Args); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, opt := range options {
+		if isPresetOption(opt.Name) || isWatermarkNameOption(opt.Name) {
+			continue
+		}
+
+		if err := applyProcessingOption(po, opt.Name, opt.Args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseURLOptions splits the leading name:arg1:arg2 parts of the path,
+// the rest of the parts are returned untouched
+func parseURLOptions(opts []string) (urlOptions, []string) {
+	parsed := make(urlOptions, 0, len(opts))
+	urlStart := len(opts)
+
+	for i, opt := range opts {
+		args := strings.Split(opt, ":")
+
+		if len(args) == 1 {
+			urlStart = i
+			break
+		}
+
+		parsed = append(parsed, urlOption{args[0], args[1:]})
+	}
+
+	return parsed, opts[urlStart:]
+}
+
+// parseProcessPath parses /{options}/{id} into processing options and image id
+func parseProcessPath(path string) (*processingOptions, string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	options, rest := parseURLOptions(parts)
+
+	if len(rest) != 1 || len(rest[0]) == 0 {
+		return nil, "", errors.New("Invalid path")
+	}
+
+	po := newProcessingOptions()
+
+	if err := applyProcessingOptions(po, options); err != nil {
+		return nil, "", err
+	}
+
+	return po, rest[0], nil
+}
+
+// uploadOptionNames maps upload parameters to processing options
+var uploadOptionNames = map[string]string{
+	"width":      "width",
+	"height":     "height",
+	"resize":     "resizing_type",
+	"gravity":    "gravity",
+	"quality":    "quality",
+	"format":     "format",
+	"blur":       "blur",
+	"sharpen":    "sharpen",
+	"background": "background",
+	"watermark":  "watermark",
+}
+
+// parseUploadProcessingOptions merges the upload parameters over defaultOption.
+// Multi-argument values are colon separated like in URLs: gravity=fp:0.5:0.3, background=255:255:255,
+// watermark=opacity:position:x_offset:y_offset:scale.
+// Comma separated presets are applied first, in order: preset=listing,hq
+func parseUploadProcessingOptions(value func(name string) string) (*processingOptions, error) {
+	po := newProcessingOptions()
+
+	if v := value("preset"); len(v) > 0 {
+		if err := applyPresetOption(po, strings.Split(v, ",")); err != nil {
+			return nil, err
+		}
+	}
+
+	// the named watermark defaults go before the explicit watermark option
+	if v := value("watermark_name"); len(v) > 0 {
+		if err := applyWatermarkNameOption(po, []string{v}); err != nil {
+			return nil, err
+		}
+	}
+
+	// plain text here, watermark_font=%font:%size:%hex_color styles it
+	if v := value("watermark_text"); len(v) > 0 {
+		args := []string{base64.RawURLEncoding.EncodeToString([]byte(v))}
+		if style := value("watermark_font"); len(style) > 0 {
+			args = append(args, strings.Split(style, ":")...)
+		}
+
+		if err := applyWatermarkTextOption(po, args); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, option := range uploadOptionNames {
+		v := value(name)
+		if len(v) == 0 {
+			continue
+		}
+
+		if err := applyProcessingOption(po, option, strings.Split(v, ":")); err != nil {
+			return nil, err
+		}
+	}
+
+	return po, nil
+}
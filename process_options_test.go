@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProcessPath(t *testing.T) {
+	defer func(def *processingOptions, p map[string]urlOptions, wm map[string]watermarkOptions, text bool) {
+		defaultOption, presets, watermarkPresets, vipsSupportText = def, p, wm, text
+	}(defaultOption, presets, watermarkPresets, vipsSupportText)
+
+	defaultOption = &processingOptions{
+		Dpr:       1,
+		Resize:    resizeFit,
+		Quality:   80,
+		Width:     1640,
+		Height:    1480,
+		Gravity:   gravityOptions{Type: gravityCenter},
+		Watermark: watermarkOptions{Opacity: 1, Gravity: gravityCenter},
+	}
+
+	presets = make(map[string]urlOptions)
+	for name, value := range map[string]string{"listing": "rs:fit:640:640/q:85", "hq": "q:95"} {
+		if err := parsePreset(name, value); err != nil {
+			t.Fatalf("parsePreset(%s) error = %v", name, err)
+		}
+	}
+
+	property := watermarkOptions{Name: "property", Enabled: true, Opacity: 0.6, Gravity: gravitySouthEast, OffsetX: 20, OffsetY: 20, Scale: 0.2}
+	watermarkPresets = map[string]watermarkOptions{"property": property}
+
+	vipsSupportText = true
+
+	tests := []struct {
+		path    string
+		wantErr bool
+		check   func(po *processingOptions) bool
+	}{
+		{
+			path:  "rs:fit:300:300/w:500/image",
+			check: func(po *processingOptions) bool { return po.Resize == resizeFit && po.Width == 500 && po.Height == 300 },
+		},
+		{
+			path: "w:500/rs:fill:300:300/image",
+			check: func(po *processingOptions) bool {
+				return po.Resize == resizeFill && po.Width == 300 && po.Height == 300
+			},
+		},
+		{
+			path: "pr:listing/q:60/image",
+			check: func(po *processingOptions) bool {
+				return po.Width == 640 && po.Quality == 60 && reflect.DeepEqual(po.UsedPresets, []string{"listing"})
+			},
+		},
+		{
+			path:  "q:60/pr:listing/image",
+			check: func(po *processingOptions) bool { return po.Width == 640 && po.Quality == 60 },
+		},
+		{
+			path: "pr:listing:hq/image",
+			check: func(po *processingOptions) bool {
+				return po.Quality == 95 && reflect.DeepEqual(po.UsedPresets, []string{"listing", "hq"})
+			},
+		},
+		{
+			path:  "wmn:property/image",
+			check: func(po *processingOptions) bool { return po.Watermark == property },
+		},
+		{
+			path: "wmn:property/wm:0.3:nowe/image",
+			check: func(po *processingOptions) bool {
+				wm := po.Watermark
+				return wm.Opacity == 0.3 && wm.Gravity == gravityNorthWest && wm.OffsetX == 20 && wm.Scale == 0.2
+			},
+		},
+		{
+			path: "wm:0.3:nowe/wmn:property/image",
+			check: func(po *processingOptions) bool {
+				wm := po.Watermark
+				return wm.Opacity == 0.3 && wm.Gravity == gravityNorthWest && wm.OffsetX == 20 && wm.Scale == 0.2
+			},
+		},
+		{
+			path: "wmt:SGk/wmn:property/image",
+			check: func(po *processingOptions) bool {
+				wm := po.Watermark
+				return wm.Text == "Hi" && wm.Opacity == 0.6 && wm.Gravity == gravitySouthEast
+			},
+		},
+		{path: "w:abc/image", wantErr: true},
+		{path: "w:-1/image", wantErr: true},
+		{path: "q:0/image", wantErr: true},
+		{path: "rs:fit:300:300:1:1:1/image", wantErr: true},
+		{path: "rs:round/image", wantErr: true},
+		{path: "wm:2/image", wantErr: true},
+		{path: "wmn:unknown/image", wantErr: true},
+		{path: "wmn:property:other/image", wantErr: true},
+		{path: "pr:unknown/image", wantErr: true},
+		{path: "bogus:1/image", wantErr: true},
+		{path: "w:100", wantErr: true},
+		{path: "w:100/image/more", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			po, id, err := parseProcessPath(tt.path)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseProcessPath() = %+v, want error", po)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseProcessPath() error = %v", err)
+			}
+
+			if id != "image" {
+				t.Errorf("parseProcessPath() id = %q, want %q", id, "image")
+			}
+
+			if !tt.check(po) {
+				t.Errorf("parseProcessPath() = %+v", po)
+			}
+		})
+	}
+}
+
+func TestParsePreset(t *testing.T) {
+	defer func(def *processingOptions, p map[string]urlOptions) {
+		defaultOption, presets = def, p
+	}(defaultOption, presets)
+
+	defaultOption = &processingOptions{Dpr: 1, Resize: resizeFit, Quality: 80}
+	presets = make(map[string]urlOptions)
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"listing", "rs:fit:640:640/q:85", false},
+		{"", "q:85", true},
+		{"a:b", "q:85", true},
+		{"nested", "pr:listing/q:85", true},
+		{"broken", "q:abc", true},
+		{"with_id", "q:85/image", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			if err := parsePreset(tt.name, tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("parsePreset(%q, %q) error = %v, want error %v", tt.name, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -23,6 +23,14 @@ var (
 	prometheusVipsMemory         prometheus.Gauge
 	prometheusVipsMaxMemory      prometheus.Gauge
 	prometheusVipsAllocs         prometheus.Gauge
+	prometheusStorageRetries     *prometheus.CounterVec
+	prometheusStorageFailures    *prometheus.CounterVec
+
+	prometheusReplicationWrites            *prometheus.CounterVec
+	prometheusReplicationRepairs           *prometheus.CounterVec
+	prometheusReplicationRepairQueueLength prometheus.Gauge
+
+	prometheusWebhookDeliveries *prometheus.CounterVec
 )
 
 func initPrometheus() {
@@ -81,6 +89,36 @@ func initPrometheus() {
 		Help: "A gauge of the number of active vips allocations.",
 	})
 
+	prometheusStorageRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_retries_total",
+		Help: "A counter of the retried storage calls separated by method.",
+	}, []string{"method"})
+
+	prometheusStorageFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_failures_total",
+		Help: "A counter of the storage calls failed after all retries separated by method.",
+	}, []string{"method"})
+
+	prometheusReplicationWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_writes_total",
+		Help: "A counter of the replicated writes separated by target and result.",
+	}, []string{"target", "result"})
+
+	prometheusReplicationRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_repairs_total",
+		Help: "A counter of the replication repair outcomes separated by result.",
+	}, []string{"result"})
+
+	prometheusReplicationRepairQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "replication_repair_queue_length",
+		Help: "A gauge of the number of secondary writes waiting for repair.",
+	})
+
+	prometheusWebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "A counter of the webhook deliveries separated by event and result.",
+	}, []string{"event", "result"})
+
 	prometheus.MustRegister(
 		prometheusRequestsTotal,
 		prometheusErrorsTotal,
@@ -93,6 +131,12 @@ func initPrometheus() {
 		prometheusVipsMemory,
 		prometheusVipsMaxMemory,
 		prometheusVipsAllocs,
+		prometheusStorageRetries,
+		prometheusStorageFailures,
+		prometheusReplicationWrites,
+		prometheusReplicationRepairs,
+		prometheusReplicationRepairQueueLength,
+		prometheusWebhookDeliveries,
 	)
 
 	prometheusEnabled = true
@@ -122,3 +166,27 @@ func setPrometheusBufferDefaultSize(t string, size int) {
 func setPrometheusBufferMaxSize(t string, size int) {
 	prometheusBufferMaxSize.With(prometheus.Labels{"type": t}).Set(float64(size))
 }
+
+func incrementPrometheusStorageRetries(method string) {
+	prometheusStorageRetries.With(prometheus.Labels{"method": method}).Inc()
+}
+
+func incrementPrometheusStorageFailures(method string) {
+	prometheusStorageFailures.With(prometheus.Labels{"method": method}).Inc()
+}
+
+func incrementPrometheusReplicationWrites(target, result string) {
+	prometheusReplicationWrites.With(prometheus.Labels{"target": target, "result": result}).Inc()
+}
+
+func incrementPrometheusReplicationRepairs(result string) {
+	prometheusReplicationRepairs.With(prometheus.Labels{"result": result}).Inc()
+}
+
+func setPrometheusReplicationRepairQueueLength(n int) {
+	prometheusReplicationRepairQueueLength.Set(float64(n))
+}
+
+func incrementPrometheusWebhookDeliveries(event, result string) {
+	prometheusWebhookDeliveries.With(prometheus.Labels{"event": event, "result": result}).Inc()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo"
+	"golang.org/x/sync/errgroup"
+)
+
+const imageRenditionsKey = "renditions"
+
+type rendition struct {
+	name string
+	po   *processingOptions
+}
+
+// processedImage is a rendition produced by processImageRenditions
+type processedImage struct {
+	data   []byte
+	width  int
+	height int
+}
+
+var renditions []rendition
+
+func initRenditions() {
+	for _, r := range config.Renditions {
+		if len(r.Name) == 0 || strings.ContainsAny(r.Name, "/.:") {
+			log.Fatalf("Invalid rendition name: %q", r.Name)
+		}
+
+		po := newProcessingOptions()
+
+		if len(r.Resize) > 0 {
+			if err := applyResizingTypeOption(po, []string{r.Resize}); err != nil {
+				log.Fatalf("Invalid rendition %s: %s", r.Name, err)
+			}
+		}
+
+		if len(r.Format) > 0 {
+			if err := applyFormatOption(po, []string{r.Format}); err != nil {
+				log.Fatalf("Invalid rendition %s: %s", r.Name, err)
+			}
+		}
+
+		po.Width = r.Width
+		po.Height = r.Height
+
+		if r.Quality > 0 {
+			po.Quality = r.Quality
+		}
+
+		renditions = append(renditions, rendition{r.Name, po})
+	}
+}
+
+// renditionObjectID names the rendition next to the original: <md5>-<id>_<name>.<format>
+func renditionObjectID(objectID string, r rendition) string {
+	return fmt.Sprintf("%s_%s.%s", strings.TrimSuffix(objectID, path.Ext(objectID)), r.name, renditionExt(r))
+}
+
+func renditionExt(r rendition) string {
+	if r.po.Format == imageTypes[config.Storage.GCS.Format] {
+		return config.Storage.GCS.Format
+	}
+	return r.po.Format.String()
+}
+
+func renditionOptions() []*processingOptions {
+	pos := make([]*processingOptions, len(renditions))
+	for i, r := range renditions {
+		po := *r.po
+		pos[i] = &po
+	}
+	return pos
+}
+
+// storeRenditions puts the processed renditions next to the original and describes them for the response
+func storeRenditions(c echo.Context, objectID string) ([]map[string]interface{}, error) {
+	images, ok := c.Get(imageRenditionsKey).([]processedImage)
+	if !ok {
+		return nil, nil
+	}
+
+	res := make([]map[string]interface{}, len(images))
+
+	var errg errgroup.Group
+
+	for i := range images {
+		ind := i
+		errg.Go(func() error {
+			id := renditionObjectID(objectID, renditions[ind])
+
+			if err := invokeStorageClient(http.MethodPut, storageObjectURL(id), bytes.NewReader(images[ind].data)); err != nil {
+				return err
+			}
+
+			res[ind] = map[string]interface{}{
+				"name":   renditions[ind].name,
+				"width":  images[ind].width,
+				"height": images[ind].height,
+				"url":    genGCSURL(config.Storage.GCS.BaseURL, config.Storage.GCS.RenditionConfig, id),
+			}
+
+			return nil
+		})
+	}
+
+	if err := errg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// deleteRenditions removes the renditions of the object, missing ones are fine
+func deleteRenditions(objectID string) error {
+	var errg errgroup.Group
+
+	for _, r := range renditions {
+		url := storageObjectURL(renditionObjectID(objectID, r))
+		errg.Go(func() error {
+			return deleteStorageObject(url)
+		})
+	}
+
+	return errg.Wait()
+}
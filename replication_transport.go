@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	replicationModeSync  = "sync"
+	replicationModeAsync = "async"
+
+	defaultReplicationTimeout = 30 * time.Second
+
+	defaultRepairQueueBytes = 256 << 20
+)
+
+type replicationTarget struct {
+	name string
+	url  *url.URL
+}
+
+type repairTask struct {
+	method   string
+	url      string
+	target   string
+	data     []byte
+	attempts int
+}
+
+// replicationTransport writes every PUT and DELETE to the primary storage and to the secondaries.
+// The primary is always written synchronously and must succeed. Secondaries are written concurrently:
+// in sync mode we wait for all of them, in async mode only until the quorum is reached.
+// Failed secondary writes are put into the repair queue and replayed in background,
+// unless a newer write to the same object was made meanwhile.
+type replicationTransport struct {
+	next http.RoundTripper
+
+	secondaries []replicationTarget
+	mode        string
+	quorum      int
+
+	repairQueue       chan *repairTask
+	repairQueueBytes  int
+	repairInterval    time.Duration
+	repairMaxAttempts int
+
+	// repairMutex guards queuedBytes and latestWrites.
+	// latestWrites holds the newest unfinished write per secondary URL,
+	// a queued task that isn't there anymore is outdated.
+	repairMutex  sync.Mutex
+	queuedBytes  int
+	latestWrites map[string]*repairTask
+
+	timeout time.Duration
+}
+
+func newReplicationTransport(next http.RoundTripper) http.RoundTripper {
+	conf := config.Storage.Replication
+
+	t := &replicationTransport{
+		next:              next,
+		mode:              conf.Mode,
+		quorum:            conf.Quorum,
+		repairQueue:       make(chan *repairTask, maxInt(conf.RepairQueueSize, 1)),
+		repairQueueBytes:  conf.RepairQueueBytes,
+		repairInterval:    conf.RepairInterval,
+		repairMaxAttempts: conf.RepairMaxAttempts,
+		timeout:           conf.Timeout,
+		latestWrites:      make(map[string]*repairTask),
+	}
+
+	if t.repairQueueBytes <= 0 {
+		t.repairQueueBytes = defaultRepairQueueBytes
+	}
+
+	// a zero deadline would fail every secondary write right away
+	if t.timeout <= 0 {
+		t.timeout = config.Iris.Timeout
+	}
+	if t.timeout <= 0 {
+		t.timeout = defaultReplicationTimeout
+	}
+
+	if t.mode != replicationModeAsync {
+		t.mode = replicationModeSync
+	}
+
+	for _, s := range conf.Secondaries {
+		u, err := url.Parse(s)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			log.Fatalf("Invalid replication target %s, expected scheme://bucket", s)
+		}
+		t.secondaries = append(t.secondaries, replicationTarget{s, u})
+	}
+
+	// Primary is always counted, the quorum can't be bigger than all the stores
+	t.quorum = maxInt(1, minInt(t.quorum, len(t.secondaries)+1))
+
+	go t.repairLoop()
+
+	return t
+}
+
+func (t *replicationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		return t.next.RoundTrip(req)
+	}
+
+	var data []byte
+
+	if req.Body != nil {
+		var err error
+		if data, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+
+		req = cloneRequest(req)
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		req.ContentLength = int64(len(data))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !t.replicated(req.Method, resp) {
+		if prometheusEnabled {
+			incrementPrometheusReplicationWrites("primary", "failure")
+		}
+		return resp, err
+	}
+
+	if prometheusEnabled {
+		incrementPrometheusReplicationWrites("primary", "success")
+	}
+
+	if len(t.secondaries) == 0 {
+		return resp, nil
+	}
+
+	results := make(chan bool, len(t.secondaries))
+
+	for _, target := range t.secondaries {
+		go func(target replicationTarget) {
+			results <- t.writeSecondary(req, target, data)
+		}(target)
+	}
+
+	acked := 1
+	waitFor := len(t.secondaries)
+
+	for i := 0; i < waitFor; i++ {
+		// the primary alone may already be the quorum
+		if t.mode == replicationModeAsync && acked >= t.quorum {
+			break
+		}
+
+		if <-results {
+			acked++
+		}
+	}
+
+	if acked < t.quorum {
+		log.Errorf("Replication quorum not reached for %s %s: %d of %d", req.Method, req.URL, acked, t.quorum)
+		resp.Body.Close()
+		return newStorageResponse(req, http.StatusServiceUnavailable), nil
+	}
+
+	return resp, nil
+}
+
+// replicated reports whether the store has the desired state after the call.
+// Deleting an object which doesn't exist is fine for secondaries.
+func (t *replicationTransport) replicated(method string, resp *http.Response) bool {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return true
+	}
+	return method == http.MethodDelete && resp.StatusCode == http.StatusNotFound
+}
+
+func (t *replicationTransport) secondaryURL(primary *url.URL, target replicationTarget) string {
+	u := *primary
+	u.Scheme = target.url.Scheme
+	u.Host = target.url.Host
+	return u.String()
+}
+
+func (t *replicationTransport) writeSecondary(primary *http.Request, target replicationTarget, data []byte) bool {
+	task := &repairTask{
+		method: primary.Method,
+		url:    t.secondaryURL(primary.URL, target),
+		target: target.name,
+		data:   data,
+	}
+
+	t.repairMutex.Lock()
+	t.latestWrites[task.url] = task
+	t.repairMutex.Unlock()
+
+	if t.do(task) {
+		t.finishRepair(task)
+		return true
+	}
+
+	t.enqueueRepair(task)
+
+	return false
+}
+
+// do runs the task with its own deadline since async writes outlive the incoming request
+func (t *replicationTransport) do(task *repairTask) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	task.attempts++
+
+	// a typed nil *bytes.Reader would make http.NewRequest panic on DELETE
+	var body io.Reader
+	if task.data != nil {
+		body = bytes.NewReader(task.data)
+	}
+
+	req, err := http.NewRequest(task.method, task.url, body)
+	if err != nil {
+		log.Errorf("Can't create replication request %s %s: %s", task.method, task.url, err)
+		return false
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		log.Warnf("Replication %s %s failed: %s", task.method, task.url, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	ok := err == nil && t.replicated(task.method, resp)
+
+	if prometheusEnabled {
+		result := "success"
+		if !ok {
+			result = "failure"
+		}
+		incrementPrometheusReplicationWrites(task.target, result)
+	}
+
+	return ok
+}
+
+// finishRepair forgets the task unless a newer write to the same URL has replaced it
+func (t *replicationTransport) finishRepair(task *repairTask) {
+	t.repairMutex.Lock()
+	defer t.repairMutex.Unlock()
+
+	if t.latestWrites[task.url] == task {
+		delete(t.latestWrites, task.url)
+	}
+}
+
+// outdated reports whether a newer write to the task's URL was made, replaying it would undo that write
+func (t *replicationTransport) outdated(task *repairTask) bool {
+	t.repairMutex.Lock()
+	defer t.repairMutex.Unlock()
+
+	return t.latestWrites[task.url] != task
+}
+
+func (t *replicationTransport) enqueueRepair(task *repairTask) {
+	// Queued PUTs hold the whole object, so the queue is limited by bytes as well
+	t.repairMutex.Lock()
+	fits := t.queuedBytes+len(task.data) <= t.repairQueueBytes
+	if fits {
+		t.queuedBytes += len(task.data)
+	}
+	t.repairMutex.Unlock()
+
+	if fits {
+		select {
+		case t.repairQueue <- task:
+			if prometheusEnabled {
+				setPrometheusReplicationRepairQueueLength(len(t.repairQueue))
+			}
+			return
+		default:
+			t.dequeueRepair(task)
+		}
+	}
+
+	log.Errorf("Replication repair queue is full, dropping %s %s", task.method, task.url)
+	if prometheusEnabled {
+		incrementPrometheusReplicationRepairs("dropped")
+	}
+
+	t.finishRepair(task)
+}
+
+func (t *replicationTransport) dequeueRepair(task *repairTask) {
+	t.repairMutex.Lock()
+	t.queuedBytes -= len(task.data)
+	t.repairMutex.Unlock()
+}
+
+func (t *replicationTransport) repairLoop() {
+	for task := range t.repairQueue {
+		t.dequeueRepair(task)
+
+		if prometheusEnabled {
+			setPrometheusReplicationRepairQueueLength(len(t.repairQueue))
+		}
+
+		time.Sleep(t.repairInterval)
+
+		if t.outdated(task) {
+			log.Infof("Replication skipped %s %s, the object was written since", task.method, task.url)
+			if prometheusEnabled {
+				incrementPrometheusReplicationRepairs("outdated")
+			}
+			continue
+		}
+
+		if t.do(task) {
+			log.Infof("Replication repaired %s %s after %d attempts", task.method, task.url, task.attempts)
+			if prometheusEnabled {
+				incrementPrometheusReplicationRepairs("repaired")
+			}
+			t.finishRepair(task)
+			continue
+		}
+
+		if task.attempts >= t.repairMaxAttempts {
+			log.Errorf("Replication gave up on %s %s after %d attempts", task.method, task.url, task.attempts)
+			if prometheusEnabled {
+				incrementPrometheusReplicationRepairs("given_up")
+			}
+			t.finishRepair(task)
+			continue
+		}
+
+		t.enqueueRepair(task)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStorage answers every request with the status set for its host
+type fakeStorage struct {
+	mu       sync.Mutex
+	statuses map[string]int
+	blocks   map[string]chan struct{}
+	calls    []string
+}
+
+func (s *fakeStorage) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, req.Method+" "+req.URL.Host)
+	status, ok := s.statuses[req.URL.Host]
+	block := s.blocks[req.URL.Host]
+	s.mu.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	if !ok {
+		status = http.StatusOK
+	}
+
+	return newStorageResponse(req, status), nil
+}
+
+func (s *fakeStorage) setStatus(host string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[host] = status
+}
+
+func (s *fakeStorage) count(call string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, c := range s.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+// newTestReplication builds the transport over a fake storage, the config is only read by the constructor
+func newTestReplication(mode string, quorum int) (*replicationTransport, *fakeStorage) {
+	conf := &config.Storage.Replication
+
+	saved := *conf
+	defer func() { *conf = saved }()
+
+	conf.Secondaries = []string{"s3://dr1", "s3://dr2"}
+	conf.Mode = mode
+	conf.Quorum = quorum
+	conf.RepairQueueSize = 10
+	conf.RepairQueueBytes = 0
+	conf.RepairInterval = 50 * time.Millisecond
+	conf.RepairMaxAttempts = 1
+	conf.Timeout = time.Second
+
+	fake := &fakeStorage{statuses: make(map[string]int), blocks: make(map[string]chan struct{})}
+
+	return newReplicationTransport(fake).(*replicationTransport), fake
+}
+
+func newTestStorageRequest(method string, data []byte) *http.Request {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequest(method, "gs://bucket/object", body)
+	return req
+}
+
+func TestReplicationTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		quorum    int
+		method    string
+		statuses  map[string]int
+		want      int
+		wantCalls []string
+	}{
+		{
+			name:      "sync all written",
+			mode:      replicationModeSync,
+			quorum:    3,
+			method:    http.MethodPut,
+			want:      http.StatusOK,
+			wantCalls: []string{"PUT bucket", "PUT dr1", "PUT dr2"},
+		},
+		{
+			name:     "sync quorum missed",
+			mode:     replicationModeSync,
+			quorum:   3,
+			method:   http.MethodPut,
+			statuses: map[string]int{"dr2": http.StatusInternalServerError},
+			want:     http.StatusServiceUnavailable,
+		},
+		{
+			name:     "sync quorum reached without a secondary",
+			mode:     replicationModeSync,
+			quorum:   2,
+			method:   http.MethodPut,
+			statuses: map[string]int{"dr2": http.StatusInternalServerError},
+			want:     http.StatusOK,
+		},
+		{
+			name:     "async primary is the quorum",
+			mode:     replicationModeAsync,
+			quorum:   1,
+			method:   http.MethodPut,
+			statuses: map[string]int{"dr1": http.StatusInternalServerError, "dr2": http.StatusInternalServerError},
+			want:     http.StatusOK,
+		},
+		{
+			name:     "async quorum missed",
+			mode:     replicationModeAsync,
+			quorum:   2,
+			method:   http.MethodPut,
+			statuses: map[string]int{"dr1": http.StatusInternalServerError, "dr2": http.StatusInternalServerError},
+			want:     http.StatusServiceUnavailable,
+		},
+		{
+			name:      "primary failed",
+			mode:      replicationModeSync,
+			quorum:    1,
+			method:    http.MethodPut,
+			statuses:  map[string]int{"bucket": http.StatusInternalServerError},
+			want:      http.StatusInternalServerError,
+			wantCalls: []string{"PUT bucket"},
+		},
+		{
+			name:      "delete without body",
+			mode:      replicationModeSync,
+			quorum:    3,
+			method:    http.MethodDelete,
+			statuses:  map[string]int{"bucket": http.StatusNoContent, "dr1": http.StatusNoContent, "dr2": http.StatusNoContent},
+			want:      http.StatusNoContent,
+			wantCalls: []string{"DELETE bucket", "DELETE dr1", "DELETE dr2"},
+		},
+		{
+			name:     "delete missing on secondaries",
+			mode:     replicationModeSync,
+			quorum:   3,
+			method:   http.MethodDelete,
+			statuses: map[string]int{"dr1": http.StatusNotFound, "dr2": http.StatusNotFound},
+			want:     http.StatusOK,
+		},
+		{
+			name:     "delete missing on primary",
+			mode:     replicationModeSync,
+			quorum:   3,
+			method:   http.MethodDelete,
+			statuses: map[string]int{"bucket": http.StatusNotFound, "dr1": http.StatusNotFound, "dr2": http.StatusNotFound},
+			want:     http.StatusNotFound,
+		},
+		{
+			name:      "reads go to the primary only",
+			mode:      replicationModeSync,
+			quorum:    3,
+			method:    http.MethodGet,
+			want:      http.StatusOK,
+			wantCalls: []string{"GET bucket"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, fake := newTestReplication(tt.mode, tt.quorum)
+			for host, status := range tt.statuses {
+				fake.setStatus(host, status)
+			}
+
+			var data []byte
+			if tt.method == http.MethodPut {
+				data = []byte("image")
+			}
+
+			resp, err := rt.RoundTrip(newTestStorageRequest(tt.method, data))
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, tt.want)
+			}
+
+			if tt.wantCalls == nil || tt.mode == replicationModeAsync {
+				return
+			}
+
+			for _, call := range tt.wantCalls {
+				if fake.count(call) != 1 {
+					t.Errorf("%s called %d times, want 1", call, fake.count(call))
+				}
+			}
+			if n := len(fake.calls); n != len(tt.wantCalls) {
+				t.Errorf("%d calls, want %v", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestReplicationTransportAsyncDoesntWait(t *testing.T) {
+	rt, fake := newTestReplication(replicationModeAsync, 2)
+
+	block := make(chan struct{})
+	defer close(block)
+	fake.blocks["dr2"] = block
+
+	done := make(chan int)
+	go func() {
+		resp, err := rt.RoundTrip(newTestStorageRequest(http.MethodPut, []byte("image")))
+		if err != nil {
+			t.Error(err)
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+
+	select {
+	case status := <-done:
+		if status != http.StatusOK {
+			t.Errorf("RoundTrip() status = %d, want %d", status, http.StatusOK)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RoundTrip() waited for the slow secondary after the quorum")
+	}
+}
+
+func TestReplicationTransportRepair(t *testing.T) {
+	rt, fake := newTestReplication(replicationModeSync, 1)
+	fake.setStatus("dr1", http.StatusInternalServerError)
+
+	resp, _ := rt.RoundTrip(newTestStorageRequest(http.MethodPut, []byte("image")))
+	resp.Body.Close()
+
+	fake.setStatus("dr1", http.StatusOK)
+
+	deadline := time.Now().Add(time.Second)
+	for fake.count("PUT dr1") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := fake.count("PUT dr1"); n != 2 {
+		t.Errorf("PUT dr1 called %d times, want the failed write replayed once", n)
+	}
+}
+
+func TestReplicationTransportRepairAfterDelete(t *testing.T) {
+	rt, fake := newTestReplication(replicationModeSync, 1)
+	fake.setStatus("dr1", http.StatusInternalServerError)
+
+	resp, _ := rt.RoundTrip(newTestStorageRequest(http.MethodPut, []byte("image")))
+	resp.Body.Close()
+
+	fake.setStatus("dr1", http.StatusNoContent)
+
+	resp, _ = rt.RoundTrip(newTestStorageRequest(http.MethodDelete, nil))
+	resp.Body.Close()
+
+	time.Sleep(4 * rt.repairInterval)
+
+	if n := fake.count("PUT dr1"); n != 1 {
+		t.Errorf("PUT dr1 called %d times, the deleted object was written back", n)
+	}
+}
+
+func TestReplicationTransportRepairQueueBytes(t *testing.T) {
+	rt, fake := newTestReplication(replicationModeSync, 1)
+	rt.repairQueueBytes = 4
+	fake.setStatus("dr1", http.StatusInternalServerError)
+
+	resp, _ := rt.RoundTrip(newTestStorageRequest(http.MethodPut, []byte("image")))
+	resp.Body.Close()
+
+	time.Sleep(4 * rt.repairInterval)
+
+	if n := fake.count("PUT dr1"); n != 1 {
+		t.Errorf("PUT dr1 called %d times, the write doesn't fit into the queue", n)
+	}
+
+	rt.repairMutex.Lock()
+	defer rt.repairMutex.Unlock()
+
+	if rt.queuedBytes != 0 || len(rt.latestWrites) != 0 {
+		t.Errorf("queuedBytes = %d, latestWrites = %v after a dropped write", rt.queuedBytes, rt.latestWrites)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Resumable uploads follow the tus protocol core:
+// POST creates a session, PATCH appends chunks at the given offset,
+// HEAD reports the progress and finalize feeds the assembled file to the usual upload chain.
+// Sessions live in config.Iris.ResumableDir as <id>.info (JSON) and <id>.part (data),
+// the offset is the size of the .part file.
+
+const (
+	tusVersion = "1.0.0"
+
+	headerTusResumable = "Tus-Resumable"
+	headerUploadOffset = "Upload-Offset"
+	headerUploadLength = "Upload-Length"
+)
+
+var (
+	resumableSessionIDRegex = regexp.MustCompile("^[0-9a-f]{32}$")
+
+	resumableLocksMutex sync.Mutex
+	resumableLocks      = make(map[string]*sync.Mutex)
+)
+
+type resumableSession struct {
+	ID      string    `json:"id"`
+	Length  int64     `json:"length"`
+	Created time.Time `json:"created"`
+
+	offset int64
+}
+
+func initResumable() {
+	if err := os.MkdirAll(config.Iris.ResumableDir, 0755); err != nil {
+		log.Fatalf("Can't create resumable uploads dir %s: %s", config.Iris.ResumableDir, err)
+	}
+
+	if config.Iris.ResumableTTL > 0 {
+		go func() {
+			for range time.Tick(config.Iris.ResumableTTL / 2) {
+				cleanExpiredResumableSessions()
+			}
+		}()
+	}
+}
+
+func resumableInfoPath(id string) string {
+	return filepath.Join(config.Iris.ResumableDir, id+".info")
+}
+
+func resumablePartPath(id string) string {
+	return filepath.Join(config.Iris.ResumableDir, id+".part")
+}
+
+func resumableSessionExists(id string) bool {
+	if !resumableSessionIDRegex.MatchString(id) {
+		return false
+	}
+
+	_, err := os.Stat(resumableInfoPath(id))
+	return err == nil
+}
+
+// lockResumableSession serializes the requests touching the same session.
+// Unknown ids get no lock, so random ids can't grow resumableLocks.
+func lockResumableSession(id string) (func(), error) {
+	if !resumableSessionExists(id) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Upload session not found")
+	}
+
+	resumableLocksMutex.Lock()
+	m, ok := resumableLocks[id]
+	if !ok {
+		m = &sync.Mutex{}
+		resumableLocks[id] = m
+	}
+	resumableLocksMutex.Unlock()
+
+	m.Lock()
+
+	return func() {
+		m.Unlock()
+
+		// The session may have been removed or expired meanwhile
+		if !resumableSessionExists(id) {
+			resumableLocksMutex.Lock()
+			if resumableLocks[id] == m {
+				delete(resumableLocks, id)
+			}
+			resumableLocksMutex.Unlock()
+		}
+	}, nil
+}
+
+func loadResumableSession(id string) (*resumableSession, error) {
+	if !resumableSessionIDRegex.MatchString(id) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Upload session not found")
+	}
+
+	data, err := ioutil.ReadFile(resumableInfoPath(id))
+	if os.IsNotExist(err) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Upload session not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(resumableSession)
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(resumablePartPath(id))
+	if err != nil {
+		return nil, err
+	}
+	s.offset = stat.Size()
+
+	return s, nil
+}
+
+func removeResumableSession(id string) {
+	os.Remove(resumablePartPath(id))
+	os.Remove(resumableInfoPath(id))
+
+	resumableLocksMutex.Lock()
+	delete(resumableLocks, id)
+	resumableLocksMutex.Unlock()
+}
+
+func cleanExpiredResumableSessions() {
+	infos, err := filepath.Glob(filepath.Join(config.Iris.ResumableDir, "*.info"))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, info := range infos {
+		id := filepath.Base(info[:len(info)-len(".info")])
+
+		s, err := loadResumableSession(id)
+		if err != nil || time.Since(s.Created) > config.Iris.ResumableTTL {
+			log.Debugf("Remove expired upload session %s", id)
+			removeResumableSession(id)
+		}
+	}
+}
+
+func setResumableHeaders(c echo.Context, s *resumableSession) {
+	h := c.Response().Header()
+	h.Set(headerTusResumable, tusVersion)
+	h.Set(headerUploadOffset, strconv.FormatInt(s.offset, 10))
+	h.Set(headerUploadLength, strconv.FormatInt(s.Length, 10))
+	h.Set("Cache-Control", "no-store")
+}
+
+func createResumableUpload(c echo.Context) error {
+	length, err := strconv.ParseInt(c.Request().Header.Get(headerUploadLength), 10, 64)
+	if err != nil || length <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid Upload-Length")
+	}
+
+	if length > config.Iris.MaxFileSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, errSourceFileTooBig)
+	}
+
+	rnd := make([]byte, 16)
+	if _, err = rand.Read(rnd); err != nil {
+		return err
+	}
+
+	s := &resumableSession{
+		ID:      hex.EncodeToString(rnd),
+		Length:  length,
+		Created: time.Now(),
+	}
+
+	if err = ioutil.WriteFile(resumablePartPath(s.ID), nil, 0644); err != nil {
+		return err
+	}
+
+	info, _ := json.Marshal(s)
+	if err = ioutil.WriteFile(resumableInfoPath(s.ID), info, 0644); err != nil {
+		os.Remove(resumablePartPath(s.ID))
+		return err
+	}
+
+	setResumableHeaders(c, s)
+	c.Response().Header().Set(echo.HeaderLocation, c.Request().URL.Path+"/"+s.ID)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"session_id": s.ID,
+		"length":     s.Length,
+		"offset":     s.offset,
+	})
+}
+
+func getResumableUpload(c echo.Context) error {
+	id := c.Param("sessionId")
+
+	unlock, err := lockResumableSession(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := loadResumableSession(id)
+	if err != nil {
+		return err
+	}
+
+	setResumableHeaders(c, s)
+
+	return c.NoContent(http.StatusOK)
+}
+
+func patchResumableUpload(c echo.Context) error {
+	id := c.Param("sessionId")
+
+	unlock, err := lockResumableSession(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := loadResumableSession(id)
+	if err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get(headerUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid Upload-Offset")
+	}
+
+	// The client has to HEAD and resume from where we really are
+	if offset != s.offset {
+		setResumableHeaders(c, s)
+		return echo.NewHTTPError(http.StatusConflict, "Upload-Offset doesn't match the current offset")
+	}
+
+	f, err := os.OpenFile(resumablePartPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	left := s.Length - s.offset
+
+	// Read one byte more than needed to find out whether the chunk is too big
+	n, err := io.Copy(f, io.LimitReader(c.Request().Body, left+1))
+	if n > left {
+		f.Truncate(s.offset)
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+	}
+
+	// Keep whatever we got, the client resumes from the new offset
+	s.offset += n
+	setResumableHeaders(c, s)
+
+	if err != nil {
+		log.Debugf("Upload session %s interrupted at %d: %s", id, s.offset, err)
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func deleteResumableUpload(c echo.Context) error {
+	id := c.Param("sessionId")
+
+	unlock, err := lockResumableSession(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := loadResumableSession(id); err != nil {
+		return err
+	}
+
+	removeResumableSession(id)
+
+	c.Response().Header().Set(headerTusResumable, tusVersion)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getResumableImage is getAndCheckFileSize for a completed session.
+// The session is removed once the image is stored.
+func getResumableImage(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		log.Debug("Start getResumableImage")
+		c.Set(startTimeKey, time.Now())
+
+		id := c.Param("sessionId")
+
+		unlock, err := lockResumableSession(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		s, err := loadResumableSession(id)
+		if err != nil {
+			return err
+		}
+
+		if s.offset != s.Length {
+			setResumableHeaders(c, s)
+			return echo.NewHTTPError(http.StatusConflict, "Upload is not complete")
+		}
+
+		imgFile, err := os.Open(resumablePartPath(id))
+		if err != nil {
+			return err
+		}
+		defer imgFile.Close()
+
+		c.Set(imageFileKey, imgFile)
+		c.Set(imageFileSizeKey, s.Length)
+
+		if err = next(c); err != nil {
+			return err
+		}
+
+		removeResumableSession(id)
+
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultRetryStatuses = []string{"5xx", "429", "408"}
+
+// retryTransport retries idempotent storage calls with exponential backoff and full jitter.
+// PUT always writes the whole object under the same objectID, so replaying it is safe:
+// whichever attempt lands last leaves the very same bytes in the bucket.
+type retryTransport struct {
+	next http.RoundTripper
+
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	statuses    []string
+}
+
+func newRetryTransport(next http.RoundTripper) http.RoundTripper {
+	conf := config.Storage.Retry
+
+	statuses := conf.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+
+	return &retryTransport{
+		next:        next,
+		maxAttempts: conf.MaxAttempts,
+		baseDelay:   conf.BaseDelay,
+		maxDelay:    conf.MaxDelay,
+		statuses:    statuses,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.retryableMethod(req.Method) {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+
+		if attempt >= t.maxAttempts || !t.shouldRetry(resp, err) {
+			if prometheusEnabled && (err != nil || !t.success(resp)) {
+				incrementPrometheusStorageFailures(req.Method)
+			}
+			return resp, err
+		}
+
+		// The body was consumed by the previous attempt, we need a fresh one
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, err
+			}
+
+			req = cloneRequest(req)
+			req.Body = body
+		}
+
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		log.Warnf("Storage %s %s failed (attempt %d of %d), retrying: %v", req.Method, req.URL, attempt, t.maxAttempts, retryReason(resp, err))
+
+		if prometheusEnabled {
+			incrementPrometheusStorageRetries(req.Method)
+		}
+
+		select {
+		case <-time.After(t.backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t *retryTransport) retryableMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *retryTransport) success(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode >= 200 && resp.StatusCode <= 299
+}
+
+func (t *retryTransport) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	status := strconv.Itoa(resp.StatusCode)
+
+	for _, s := range t.statuses {
+		// "5xx" matches the whole class, "503" matches exactly
+		if strings.HasSuffix(s, "xx") {
+			if strings.HasPrefix(status, strings.TrimSuffix(s, "xx")) {
+				return true
+			}
+		} else if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns a random delay in [0, min(maxDelay, baseDelay*2^(attempt-1))]
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.baseDelay << uint(attempt-1)
+
+	if delay <= 0 || (t.maxDelay > 0 && delay > t.maxDelay) {
+		delay = t.maxDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+
+	return r
+}
+
+func retryReason(resp *http.Response, err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return resp.Status
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+type s3Transport struct {
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func newS3Transport() http.RoundTripper {
+	conf := config.Storage.S3
+
+	s3Conf := aws.NewConfig().
+		WithS3ForcePathStyle(conf.ForcePathStyle)
+
+	if len(conf.Region) > 0 {
+		s3Conf.WithRegion(conf.Region)
+	}
+
+	// MinIO and other S3-compatible stores live on a custom endpoint
+	if len(conf.Endpoint) > 0 {
+		s3Conf.WithEndpoint(conf.Endpoint)
+	}
+
+	if len(conf.AccessKeyID) > 0 && len(conf.SecretAccessKey) > 0 {
+		s3Conf.WithCredentials(credentials.NewStaticCredentials(conf.AccessKeyID, conf.SecretAccessKey, ""))
+	}
+
+	if config.Iris.IgnoreSslVerification {
+		s3Conf.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		})
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		log.Fatalf("Can't create S3 session: %s", err)
+	}
+
+	if sess.Config.Region == nil || len(*sess.Config.Region) == 0 {
+		sess.Config.Region = aws.String("us-east-1")
+	}
+
+	svc := s3.New(sess, s3Conf)
+
+	// Uploader switches to multipart upload when the body is bigger than PartSize
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		if conf.PartSize > 0 {
+			u.PartSize = conf.PartSize
+		}
+		if conf.UploadConcurrency > 0 {
+			u.Concurrency = conf.UploadConcurrency
+		}
+	})
+
+	return s3Transport{svc, uploader}
+}
+
+func (t s3Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	switch req.Method {
+	case http.MethodGet:
+		return t.readObject(req)
+	case http.MethodHead:
+		return t.statObject(req)
+	case http.MethodPut:
+		return t.writeObject(req)
+	case http.MethodDelete:
+		return t.deleteObject(req)
+	default:
+		return newStorageResponse(req, http.StatusMethodNotAllowed), nil
+	}
+}
+
+func (t s3Transport) readObject(req *http.Request) (resp *http.Response, err error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(req.URL.Host),
+		Key:    aws.String(strings.TrimPrefix(req.URL.Path, "/")),
+	}
+
+	out, err := t.svc.GetObjectWithContext(req.Context(), input)
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageObjectResponse(req, out.Body, aws.Int64Value(out.ContentLength), aws.StringValue(out.ContentType),
+		aws.StringValue(out.ETag), aws.TimeValue(out.LastModified)), nil
+}
+
+func (t s3Transport) statObject(req *http.Request) (resp *http.Response, err error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(req.URL.Host),
+		Key:    aws.String(strings.TrimPrefix(req.URL.Path, "/")),
+	}
+
+	out, err := t.svc.HeadObjectWithContext(req.Context(), input)
+	if err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageObjectResponse(req, nil, aws.Int64Value(out.ContentLength), aws.StringValue(out.ContentType),
+		aws.StringValue(out.ETag), aws.TimeValue(out.LastModified)), nil
+}
+
+func (t s3Transport) writeObject(req *http.Request) (resp *http.Response, err error) {
+	defer req.Body.Close()
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(req.URL.Host),
+		Key:    aws.String(strings.TrimPrefix(req.URL.Path, "/")),
+		Body:   req.Body,
+	}
+
+	if contentType := req.Header.Get("Content-Type"); len(contentType) > 0 {
+		input.ContentType = aws.String(contentType)
+	}
+
+	if _, err = t.uploader.UploadWithContext(req.Context(), input); err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
+
+func (t s3Transport) deleteObject(req *http.Request) (resp *http.Response, err error) {
+	bucket := aws.String(req.URL.Host)
+	key := aws.String(strings.TrimPrefix(req.URL.Path, "/"))
+
+	// S3 answers 204 to deleting a missing key, so look it up first to report 404 like the other storages
+	if _, err = t.svc.HeadObjectWithContext(req.Context(), &s3.HeadObjectInput{Bucket: bucket, Key: key}); err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	input := &s3.DeleteObjectInput{
+		Bucket: bucket,
+		Key:    key,
+	}
+
+	if _, err = t.svc.DeleteObjectWithContext(req.Context(), input); err != nil {
+		return t.errorResponse(req, err)
+	}
+
+	return newStorageResponse(req, http.StatusOK), nil
+}
+
+// errorResponse turns S3 request failures into responses with the matching status
+func (t s3Transport) errorResponse(req *http.Request, err error) (*http.Response, error) {
+	if mfErr, ok := err.(s3manager.MultiUploadFailure); ok {
+		err = mfErr.OrigErr()
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() > 0 {
+		return newStorageResponse(req, reqErr.StatusCode()), nil
+	}
+
+	return nil, err
+}
@@ -3,21 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/hmac"
 	"crypto/md5"
-	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	_ "image/gif"
@@ -28,10 +29,11 @@ import (
 )
 
 var (
-	idGen      *idGenerator
-	uploadPool *bufPool
-	saltKey    []byte
-	secretKey  []byte
+	idGen        *idGenerator
+	uploadPool   *bufPool
+	downloadPool *bufPool
+	saltKey      []byte
+	secretKey    []byte
 
 	e = echo.New()
 
@@ -51,6 +53,8 @@ var (
 	imageHeightKey            = "height"
 	imageTypeKey              = "imageType"
 	imageProcessingOptionsKey = "processingOptions"
+	imageMetadataKey          = "imageMetadata"
+	imageUploadOptionsKey     = "uploadOptions"
 	imageIDKey                = "imageID"
 	objectIDKey               = "objectID"
 	imageStorageURLKey        = "imageURL"
@@ -59,12 +63,28 @@ var (
 
 type ctxKey string
 
+const jsonUploadOverhead = 64 * 1024
+
+type jsonUploadBody struct {
+	Image    string                 `json:"image"`
+	ImageURL string                 `json:"image_url"`
+	Metadata map[string]interface{} `json:"metadata"`
+	Options  map[string]interface{} `json:"options"`
+}
+
 // start Iris
 func start() {
 	// init the handlers first
 	// then start the server
 	initVips()
 	initStorage()
+	initDownloading()
+
+	// the watermark may live in the storage
+	if err := vipsPrepareWatermark(); err != nil {
+		log.Fatal(err.Error())
+	}
+	initWatermarks()
 
 	go func() {
 		var logMemStats = config.Iris.LogMemStats
@@ -97,7 +117,16 @@ func start() {
 	}
 	log.Debugf("Default image processing config: %+v\n", *defaultOption)
 
+	initPresets()
+	initRenditions()
+
 	uploadPool = newBufPool("upload", config.Iris.Concurrency, config.Iris.BufferSize)
+	downloadPool = newBufPool("download", config.Iris.Concurrency, config.Iris.BufferSize)
+
+	initBatch()
+	initResumable()
+	initJobs()
+	initWebhooks()
 
 	tmp, err := newIDGenerator()
 	if err != nil {
@@ -118,6 +147,8 @@ func start() {
 		}
 	}
 
+	initSignatureKeys()
+
 	e.HTTPErrorHandler = errorsHandler
 
 	if config.PProf.Enabled {
@@ -131,14 +162,39 @@ func start() {
 	// dummy health check
 	e.GET("/health", health)
 
+	// admin endpoints
+	if len(config.Admin.Token) > 0 {
+		adminGroup := e.Group("/admin", adminAuth)
+
+		// re-sign urls given out before a key rotation
+		adminGroup.POST("/resign", resign)
+
+		// pick up watermarks config changes without a restart
+		adminGroup.POST("/watermarks/reload", reloadWatermarks)
+	} else {
+		log.Warn("No admin token configured, /admin endpoints are disabled")
+	}
+
 	// apis group
 	// 1i: one image
 	// add prometheus
 	apiGroup := e.Group("/v1/1i", writePrometheusResponseTime)
 
-	apiGroup.DELETE("/:id", delete, genObjectURL)                                                           //delete image
-	apiGroup.PUT("/:id", upload, getAndCheckFileSize, checkTypeAndDimensions, process, genID, genObjectURL) // upload image
-	apiGroup.POST("", upload, getAndCheckFileSize, checkTypeAndDimensions, process, genID, genObjectURL)    // upload image
+	apiGroup.GET("/process/*", transform, parseTransformation, genObjectURL, fetchImage)                                                       // transform image
+	apiGroup.GET("/:id", get, genObjectURL)                                                                                                    // get image
+	apiGroup.HEAD("/:id", get, genObjectURL)                                                                                                   // check image
+	apiGroup.DELETE("/:id", deleteImage, genObjectURL)                                                                                         //delete image
+	apiGroup.PUT("/:id", upload, getAndCheckFileSize, parseUploadOptions, checkTypeAndDimensions, enqueueUpload, process, genID, genObjectURL) // upload image
+	apiGroup.POST("/batch", batchUpload)                                                                                                       // upload several images
+	apiGroup.GET("/jobs/:jobId", getJob)                                                                                                       // async upload status
+	apiGroup.POST("", upload, getAndCheckFileSize, parseUploadOptions, checkTypeAndDimensions, enqueueUpload, process, genID, genObjectURL)    // upload image
+
+	// resumable uploads
+	apiGroup.POST("/uploads", createResumableUpload)                                                                                                                  // start resumable upload
+	apiGroup.HEAD("/uploads/:sessionId", getResumableUpload)                                                                                                          // resumable upload progress
+	apiGroup.PATCH("/uploads/:sessionId", patchResumableUpload)                                                                                                       // append chunk
+	apiGroup.DELETE("/uploads/:sessionId", deleteResumableUpload)                                                                                                     // abort resumable upload
+	apiGroup.POST("/uploads/:sessionId/finalize", upload, getResumableImage, parseUploadOptions, checkTypeAndDimensions, enqueueUpload, process, genID, genObjectURL) // finish resumable upload
 
 	go startServer()
 	waitForInterruptSignal()
@@ -184,57 +240,242 @@ func health(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]interface{}{"message": "OK"})
 }
 
-func delete(c echo.Context) error {
+func get(c echo.Context) error {
+	url := c.Get(imageStorageURLKey).(string)
+
+	res, err := doStorageRequest(c.Request().Method, url, nil)
+	if err != nil {
+		return newStorageHTTPError(err)
+	}
+	defer res.Body.Close()
+
+	header := c.Response().Header()
+	for _, k := range []string{echo.HeaderContentLength, echo.HeaderLastModified, "ETag"} {
+		if v := res.Header.Get(k); len(v) > 0 {
+			header.Set(k, v)
+		}
+	}
+
+	contentType := res.Header.Get(echo.HeaderContentType)
+
+	if c.Request().Method == http.MethodHead {
+		header.Set(echo.HeaderContentType, contentType)
+		return c.NoContent(http.StatusOK)
+	}
+
+	return c.Stream(http.StatusOK, contentType, res.Body)
+}
+
+func transform(c echo.Context) error {
+	log.Debug("Start transform")
+
+	po := c.Get(imageProcessingOptionsKey).(*processingOptions)
+
+	newData, processCancel, err := processImage(newProcessingContext(c, po))
+	defer processCancel()
+
+	if err != nil {
+		if prometheusEnabled {
+			incrementPrometheusErrorsTotal("processing")
+		}
+		return err
+	}
+
+	if len(po.UsedPresets) > 0 {
+		c.Response().Header().Set("X-Iris-Presets", strings.Join(po.UsedPresets, ","))
+	}
+
+	return c.Blob(http.StatusOK, mimes[po.Format], newData)
+}
+
+// adminAuth lets through requests with the admin token
+func adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid admin token")
+		}
+
+		return next(c)
+	}
+}
+
+func resign(c echo.Context) error {
+	var body struct {
+		URL string `json:"url" form:"url"`
+	}
+
+	if err := c.Bind(&body); err != nil || len(body.URL) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "url is required")
+	}
+
+	url, err := resignURL(body.URL)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"url": url})
+}
+
+func deleteImage(c echo.Context) error {
 	url := c.Get(imageStorageURLKey).(string)
+	objectID := c.Get(objectIDKey).(string)
+
+	// The image goes last, so a failed delete can be retried until nothing is left
+	if err := deleteSiblings(objectID); err != nil {
+		return newStorageHTTPError(err)
+	}
 
 	if err := invokeStorageClient(http.MethodDelete, url, nil); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return newStorageHTTPError(err)
 	}
 
+	notifyWebhooks(webhookEventDelete, webhookPayload(c))
+
 	return c.JSON(http.StatusOK, map[string]interface{}{"message": "OK"})
 }
 
 func upload(c echo.Context) error {
 	log.Debug("Start upload")
 
+	res, err := storeImage(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// storeImage puts the processed image to the storage and returns the upload result
+func storeImage(c echo.Context) (map[string]interface{}, error) {
 	id, err := getImageID(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
 	url := c.Get(imageStorageURLKey).(string)
 	objectID := c.Get(objectIDKey).(string)
 
+	// The original and the renditions are stored before the image,
+	// an upload that fails half way removes them and leaves no image behind
+	if config.Iris.PreserveOriginal {
+		original := bytes.NewReader(c.Get(imageDataBufferKey).(*bytes.Buffer).Bytes())
+		if err := invokeStorageClient(http.MethodPut, storageObjectURL(originalObjectID(objectID)), original); err != nil {
+			cleanupSiblings(objectID)
+			return nil, newStorageHTTPError(err)
+		}
+	}
+
+	rends, err := storeRenditions(c, objectID)
+	if err != nil {
+		cleanupSiblings(objectID)
+		return nil, newStorageHTTPError(err)
+	}
+
 	body := bytes.NewReader(c.Get(imageDataKey).([]byte))
 
 	if err := invokeStorageClient(http.MethodPut, url, body); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		cleanupSiblings(objectID)
+		return nil, newStorageHTTPError(err)
 	}
+
 	defer logProcessTime(c, c.Get(startTimeKey).(time.Time))
 	// gcs
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	res := map[string]interface{}{
 		"image_id":     id,
 		"image_width":  c.Get(imageWidthKey),
 		"image_height": c.Get(imageHeightKey),
 		"image_url":    genGCSURL(config.Storage.GCS.BaseURL, config.Storage.GCS.ImageConfig, objectID),
 		"thumb_url":    genGCSURL(config.Storage.GCS.BaseURL, config.Storage.GCS.ThumbConfig, objectID),
-	})
+	}
+
+	if config.Iris.PreserveOriginal {
+		res["original_url"] = genGCSURL(config.Storage.GCS.BaseURL, config.Storage.GCS.RenditionConfig, originalObjectID(objectID))
+		res["original_type"] = c.Get(imageTypeKey).(imageType).String()
+	}
+
+	if rends != nil {
+		res["renditions"] = rends
+	}
+
+	if po := getUploadProcessingOptions(c); len(po.UsedPresets) > 0 {
+		res["presets"] = po.UsedPresets
+	}
+
+	// json uploads get their metadata back
+	if metadata := c.Get(imageMetadataKey); metadata != nil {
+		res["metadata"] = metadata
+	}
+
+	payload := webhookPayload(c)
+	for k, v := range res {
+		payload[k] = v
+	}
+	notifyWebhooks(webhookEventUpload, payload)
+
+	return res, nil
+}
+
+// deleteSiblings removes the original and the renditions of the object, missing ones are fine.
+// The original is tried even with preserve_original off, it may have been on for the upload.
+func deleteSiblings(objectID string) error {
+	if err := deleteStorageObject(storageObjectURL(originalObjectID(objectID))); err != nil {
+		return err
+	}
+
+	return deleteRenditions(objectID)
+}
+
+func cleanupSiblings(objectID string) {
+	if err := deleteSiblings(objectID); err != nil {
+		log.Errorf("Can't clean up %s after a failed upload: %s", objectID, err)
+	}
+}
+
+// deleteStorageObject deletes the object, a missing object is not an error
+func deleteStorageObject(url string) error {
+	err := invokeStorageClient(http.MethodDelete, url, nil)
+	if se, ok := err.(*storageError); ok && se.Kind == storageErrorNotFound {
+		return nil
+	}
+	return err
 }
 
 func invokeStorageClient(method, url string, body io.Reader) error {
-	req, err := http.NewRequest(method, url, body)
+	res, err := doStorageRequest(method, url, body)
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
+
+	return nil
+}
+
+// doStorageRequest calls the storage and returns the response if it's successful.
+// The caller must close the response body.
+func doStorageRequest(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
 	res, err := storageClient.Do(req)
 	if err != nil {
-		return err
+		if prometheusEnabled {
+			incrementPrometheusErrorsTotal("storage")
+		}
+		return nil, newStorageTransportError(err)
 	}
-	if res.Body != nil {
-		defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		if prometheusEnabled {
+			incrementPrometheusErrorsTotal("storage")
+		}
+		return nil, newStorageStatusError(res.StatusCode, fmt.Sprintf("%s %s: %s", method, url, res.Status))
 	}
 
-	return nil
+	return res, nil
 }
 
 func checkDimensions(width, height int) error {
@@ -257,35 +498,25 @@ func checkTypeAndDimensions(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		log.Debug("Start checkTypeAndDimensions")
 
+		// json uploads are already decoded into a pooled buffer
+		if buf, ok := c.Get(imageDataBufferKey).(*bytes.Buffer); ok {
+			if err := checkImageConfig(c, bytes.NewReader(buf.Bytes())); err != nil {
+				return err
+			}
+			return next(c)
+		}
+
 		buf := uploadPool.Get(int(c.Get(imageFileSizeKey).(int64)))
 		defer func() {
 			log.Debug("Put buffer back")
 			uploadPool.Put(buf)
 		}()
 
-		imgFile := c.Get(imageFileKey).(multipart.File)
-		imgconf, imgtypeStr, err := image.DecodeConfig(io.TeeReader(imgFile, buf))
-		if err == image.ErrFormat {
-			return echo.NewHTTPError(http.StatusBadRequest, errSourceImageTypeNotSupported)
-		}
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err)
-		}
-
-		imgtype, imgtypeOk := imageTypes[imgtypeStr]
-		if !imgtypeOk || !vipsTypeSupportLoad[imgtype] {
-			return echo.NewHTTPError(http.StatusBadRequest, errSourceImageTypeNotSupported)
-		}
-
-		// this one already returns a http error
-		if err = checkDimensions(imgconf.Width, imgconf.Height); err != nil {
+		imgFile := c.Get(imageFileKey).(io.Reader)
+		if err := checkImageConfig(c, io.TeeReader(imgFile, buf)); err != nil {
 			return err
 		}
 
-		c.Set(imageWidthKey, imgconf.Width)
-		c.Set(imageHeightKey, imgconf.Height)
-		c.Set(imageTypeKey, imgtype)
-
 		if _, err := buf.ReadFrom(imgFile); err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
@@ -296,11 +527,47 @@ func checkTypeAndDimensions(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// checkImageConfig reads the image header only and checks its type and dimensions
+func checkImageConfig(c echo.Context, r io.Reader) error {
+	imgconf, imgtypeStr, err := image.DecodeConfig(r)
+	if err == image.ErrFormat {
+		return echo.NewHTTPError(http.StatusBadRequest, errSourceImageTypeNotSupported)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	imgtype, imgtypeOk := imageTypes[imgtypeStr]
+	if !imgtypeOk || !vipsTypeSupportLoad[imgtype] {
+		return echo.NewHTTPError(http.StatusBadRequest, errSourceImageTypeNotSupported)
+	}
+
+	// this one already returns a http error
+	if err = checkDimensions(imgconf.Width, imgconf.Height); err != nil {
+		return err
+	}
+
+	c.Set(imageWidthKey, imgconf.Width)
+	c.Set(imageHeightKey, imgconf.Height)
+	c.Set(imageTypeKey, imgtype)
+
+	return nil
+}
+
 func getAndCheckFileSize(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		log.Debug("Start getAndCheckFileSize")
 		c.Set(startTimeKey, time.Now())
 
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+			return getJSONImage(c, next)
+		}
+
+		// upload by url, the size is checked while reading
+		if sourceURL := c.FormValue("image_url"); len(sourceURL) > 0 {
+			return getRemoteImage(c, next, sourceURL)
+		}
+
 		f, err := c.FormFile("image")
 		if err != nil {
 			log.Debug(err)
@@ -329,16 +596,92 @@ func getAndCheckFileSize(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+func getRemoteImage(c echo.Context, next echo.HandlerFunc, sourceURL string) error {
+	imgFile, size, err := downloadImage(sourceURL)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	defer func() {
+		log.Debug("Close downloaded file")
+		imgFile.Close()
+	}()
+
+	c.Set(imageFileKey, imgFile)
+	c.Set(imageFileSizeKey, size)
+	return next(c)
+}
+
+// getJSONImage handles {"image": "<base64>", "metadata": {...}} bodies.
+// The image is decoded straight into a pooled buffer, checkTypeAndDimensions picks it up from there.
+func getJSONImage(c echo.Context, next echo.HandlerFunc) error {
+	// base64 grows data by 4/3, leave some room for the rest of the fields
+	maxBodySize := int64(base64.StdEncoding.EncodedLen(int(config.Iris.MaxFileSize))) + jsonUploadOverhead
+
+	var body jsonUploadBody
+
+	req := c.Request()
+	if err := json.NewDecoder(http.MaxBytesReader(c.Response(), req.Body, maxBodySize)).Decode(&body); err != nil {
+		log.Debug(err)
+		return echo.NewHTTPError(http.StatusBadRequest, errImageMissing)
+	}
+
+	if body.Metadata != nil {
+		c.Set(imageMetadataKey, body.Metadata)
+	}
+
+	if body.Options != nil {
+		c.Set(imageUploadOptionsKey, body.Options)
+	}
+
+	if len(body.Image) == 0 && len(body.ImageURL) > 0 {
+		return getRemoteImage(c, next, body.ImageURL)
+	}
+
+	data := body.Image
+	// accept data URIs as well: data:image/jpeg;base64,...
+	if strings.HasPrefix(data, "data:") {
+		if comma := strings.IndexByte(data, ','); comma >= 0 {
+			data = data[comma+1:]
+		}
+	}
+
+	if len(data) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, errImageMissing)
+	}
+
+	size := int64(base64.StdEncoding.DecodedLen(len(data)))
+	log.Debug("img size: ", size)
+
+	if size > config.Iris.MaxFileSize+2 { // DecodedLen counts the padding
+		return echo.NewHTTPError(http.StatusBadRequest, errSourceFileTooBig)
+	}
+
+	buf := uploadPool.Get(int(size))
+	defer func() {
+		log.Debug("Put buffer back")
+		uploadPool.Put(buf)
+	}()
+
+	if _, err := buf.ReadFrom(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))); err != nil {
+		log.Debug(err)
+		return echo.NewHTTPError(http.StatusBadRequest, errSourceImageTypeNotSupported)
+	}
+
+	if int64(buf.Len()) > config.Iris.MaxFileSize {
+		return echo.NewHTTPError(http.StatusBadRequest, errSourceFileTooBig)
+	}
+
+	c.Set(imageFileSizeKey, int64(buf.Len()))
+	c.Set(imageDataBufferKey, buf)
+	return next(c)
+}
+
 func process(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		log.Debug("Start process")
 
-		ctx := context.Background()
-		ctx = context.WithValue(ctx, ctxKey(imageTypeKey), c.Get(imageTypeKey))
-		ctx = context.WithValue(ctx, ctxKey(imageProcessingOptionsKey), defaultOption)
-		ctx = context.WithValue(ctx, ctxKey(imageDataBufferKey), c.Get(imageDataBufferKey))
-
-		newData, processCancel, err := processImage(ctx)
+		// The renditions are made from the same decoded source
+		newData, images, processCancel, err := processImageRenditions(newProcessingContext(c, getUploadProcessingOptions(c)), renditionOptions())
 		defer processCancel()
 		log.Debug("processed data len: ", len(newData))
 
@@ -351,21 +694,142 @@ func process(next echo.HandlerFunc) echo.HandlerFunc {
 
 		c.Set(imageDataKey, newData)
 
+		if len(images) > 0 {
+			c.Set(imageRenditionsKey, images)
+		}
+
+		return next(c)
+	}
+}
+
+func parseTransformation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		log.Debug("Start parseTransformation")
+
+		path := c.Param("*")
+
+		// /{signature}/{options}/{id}
+		sigEnd := strings.IndexByte(path, '/')
+		if sigEnd < 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "Invalid path")
+		}
+		signature, path := path[:sigEnd], path[sigEnd:]
+
+		if !config.Signature.Unsafe {
+			if err := validatePath(signature, path); err != nil {
+				return echo.NewHTTPError(http.StatusForbidden, err.Error())
+			}
+		}
+
+		po, imageID, err := parseProcessPath(path)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		c.Set(imageProcessingOptionsKey, po)
+		c.Set(imageIDKey, imageID)
+
+		return next(c)
+	}
+}
+
+// fetchImage loads the stored image and checks it the same way the upload does
+func fetchImage(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		log.Debug("Start fetchImage")
+
+		res, err := doStorageRequest(http.MethodGet, c.Get(imageStorageURLKey).(string), nil)
+		if err != nil {
+			return newStorageHTTPError(err)
+		}
+		defer res.Body.Close()
+
+		buf := downloadPool.Get(int(res.ContentLength))
+		defer func() {
+			log.Debug("Put buffer back")
+			downloadPool.Put(buf)
+		}()
+
+		if _, err := buf.ReadFrom(res.Body); err != nil {
+			return newStorageHTTPError(newStorageTransportError(err))
+		}
+
+		imgconf, imgtypeStr, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, errSourceImageTypeNotSupported)
+		}
+
+		imgtype, imgtypeOk := imageTypes[imgtypeStr]
+		if !imgtypeOk || !vipsTypeSupportLoad[imgtype] {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, errSourceImageTypeNotSupported)
+		}
+
+		c.Set(imageWidthKey, imgconf.Width)
+		c.Set(imageHeightKey, imgconf.Height)
+		c.Set(imageTypeKey, imgtype)
+		c.Set(imageFileSizeKey, int64(buf.Len()))
+		c.Set(imageDataBufferKey, buf)
+
 		return next(c)
 	}
 }
 
+// parseUploadOptions reads the optional processing parameters of the upload,
+// from the json "options" object or from the form and query values
+func parseUploadOptions(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		log.Debug("Start parseUploadOptions")
+
+		value := c.FormValue
+		if options, ok := c.Get(imageUploadOptionsKey).(map[string]interface{}); ok {
+			value = func(name string) string {
+				if v, ok := options[name]; ok && v != nil {
+					return fmt.Sprint(v)
+				}
+				return ""
+			}
+		}
+
+		po, err := parseUploadProcessingOptions(value)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		c.Set(imageProcessingOptionsKey, po)
+
+		return next(c)
+	}
+}
+
+func getUploadProcessingOptions(c echo.Context) *processingOptions {
+	if po, ok := c.Get(imageProcessingOptionsKey).(*processingOptions); ok {
+		return po
+	}
+	return defaultOption
+}
+
 func genID(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		log.Debug("Start genID")
 
-		imageID := fmt.Sprintf("%d.%s", idGen.next(), config.Storage.GCS.Format)
+		// the extension follows the requested format
+		ext := config.Storage.GCS.Format
+		if format := getUploadProcessingOptions(c).Format; format != imageTypeUnknown && format != imageTypes[ext] {
+			ext = format.String()
+		}
+
+		imageID := fmt.Sprintf("%d.%s", idGen.next(), ext)
 		c.Set(imageIDKey, imageID)
 
 		return next(c)
 	}
 }
 
+// originalObjectID names the source kept by preserve_original: <md5>-<id>_original.
+// It has no extension since the source type may differ from the processed one.
+func originalObjectID(objectID string) string {
+	return strings.TrimSuffix(objectID, path.Ext(objectID)) + "_original"
+}
+
 func getImageID(c echo.Context) (string, error) {
 	var id string
 	if idFromCtx := c.Get(imageIDKey); idFromCtx != nil {
@@ -392,16 +856,23 @@ func genObjectURL(next echo.HandlerFunc) echo.HandlerFunc {
 		// Avoid the sequential naming bottleneck
 		// https://cloud.google.com/blog/products/gcp/optimizing-your-cloud-storage-performance-google-cloud-performance-atlas
 		// That why I add md5(id)-id.[format] to the object name
-		imageIDChecksum := fmt.Sprintf("%02x", md5.Sum(([]byte)(imageID[:len(imageID)-4])))
+		imageIDChecksum := fmt.Sprintf("%02x", md5.Sum(([]byte)(strings.TrimSuffix(imageID, path.Ext(imageID)))))
 		objectID := fmt.Sprintf("%s-%s", imageIDChecksum, imageID)
 		c.Set(objectIDKey, objectID)
 
-		// gcs
-		c.Set(imageStorageURLKey, fmt.Sprintf("%s://%s/%s", config.Iris.Storage, config.Storage.GCS.BucketPrefix, objectID))
+		c.Set(imageStorageURLKey, storageObjectURL(objectID))
 		return next(c)
 	}
 }
 
+func newProcessingContext(c echo.Context, po *processingOptions) context.Context {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, ctxKey(imageTypeKey), c.Get(imageTypeKey))
+	ctx = context.WithValue(ctx, ctxKey(imageProcessingOptionsKey), po)
+	ctx = context.WithValue(ctx, ctxKey(imageDataBufferKey), c.Get(imageDataBufferKey))
+	return ctx
+}
+
 func getProcessingOptions(ctx context.Context) *processingOptions {
 	return ctx.Value(ctxKey(imageProcessingOptionsKey)).(*processingOptions)
 }
@@ -414,28 +885,15 @@ func getImageDataBuffer(ctx context.Context) *bytes.Buffer {
 	return ctx.Value(ctxKey(imageDataBufferKey)).(*bytes.Buffer)
 }
 
-// dummy watermark
-func watermarkData() ([]byte, imageType, context.CancelFunc, error) {
-	return nil, imageTypeUnknown, func() {}, nil
-}
-
 func genGCSURL(baseURL, imgConfig string, id string) string {
 	source := fmt.Sprintf("%s/%s", config.Storage.GCS.Prefix, id)
 	path := fmt.Sprintf("/%s/%s", imgConfig, source)
-	if saltKey != nil && secretKey != nil {
+	if activeSignatureKey != nil {
 		path = signPath(path)
 	}
 	return fmt.Sprintf("%s/%s", baseURL, path)
 }
 
-func signPath(path string) string {
-	mac := hmac.New(sha256.New, secretKey)
-	mac.Write(saltKey)
-	mac.Write([]byte(path))
-	signature := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
-	return fmt.Sprintf("%s%s", signature, path)
-}
-
 func logProcessTime(c echo.Context, t time.Time) {
 	url := c.Get(imageStorageURLKey).(string)
 	width := c.Get(imageWidthKey).(int)
@@ -443,5 +901,5 @@ func logProcessTime(c echo.Context, t time.Time) {
 	rawSize := c.Get(imageFileSizeKey).(int64)
 
 	processTimeFmt := "Processed option %+v in %d ms: [%s %d %d %d]\n"
-	log.Infof(processTimeFmt, *defaultOption, int(time.Since(t).Seconds()*1000), url, width, height, rawSize)
+	log.Infof(processTimeFmt, *getUploadProcessingOptions(c), int(time.Since(t).Seconds()*1000), url, width, height, rawSize)
 }
@@ -2,9 +2,14 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -49,8 +54,95 @@ func initStorage() {
 		transport.RegisterProtocol("gcs", newGCSTransport())
 	}
 
+	if config.Storage.S3.Enabled {
+		transport.RegisterProtocol("s3", newS3Transport())
+	}
+
+	if config.Storage.Ceph.Enabled {
+		transport.RegisterProtocol("ceph", newCephTransport())
+	}
+
+	if config.Storage.File.Enabled {
+		transport.RegisterProtocol("file", newFileTransport())
+	}
+
+	var rt http.RoundTripper = transport
+
+	if config.Storage.Retry.MaxAttempts > 1 {
+		rt = newRetryTransport(transport)
+	}
+
+	if config.Storage.Replication.Enabled {
+		rt = newReplicationTransport(rt)
+	}
+
 	storageClient = &http.Client{
 		Timeout:   config.Iris.Timeout,
-		Transport: transport,
+		Transport: rt,
+	}
+}
+
+// storageBucket returns the bucket (or directory) used by the current storage
+func storageBucket() string {
+	switch config.Iris.Storage {
+	case "s3":
+		return config.Storage.S3.Bucket
+	case "ceph":
+		return config.Storage.Ceph.Pool
+	case "file":
+		return config.Storage.File.Bucket
+	default:
+		return config.Storage.GCS.BucketPrefix
+	}
+}
+
+func storageObjectURL(objectID string) string {
+	return fmt.Sprintf("%s://%s/%s", config.Iris.Storage, storageBucket(), objectID)
+}
+
+func newStorageResponse(req *http.Request, statusCode int) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		ProtoMinor: 0,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Close:      true,
+		Request:    req,
+	}
+}
+
+// newStorageObjectResponse returns the object stored by the transport.
+// Body is nil for HEAD requests.
+func newStorageObjectResponse(req *http.Request, body io.ReadCloser, size int64, contentType, etag string, modTime time.Time) *http.Response {
+	resp := newStorageResponse(req, http.StatusOK)
+
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(path.Ext(req.URL.Path))
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
 	}
+
+	if len(etag) > 0 && !strings.HasPrefix(etag, `"`) {
+		etag = strconv.Quote(etag)
+	}
+
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	if len(etag) > 0 {
+		resp.Header.Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		resp.Header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	resp.ContentLength = size
+	if body != nil {
+		resp.Body = body
+	}
+
+	return resp
 }
@@ -12,8 +12,14 @@
 #define VIPS_SUPPORT_SVG \
   (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 3))
 
-#define VIPS_SUPPORT_MAGICK \
-  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 7))
+#define VIPS_SUPPORT_WEBP_ANIMATION \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 8))
+
+#define VIPS_SUPPORT_ARRAY_INT \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
+#define VIPS_SUPPORT_GIFSAVE \
+  (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 12))
 
 #define EXIF_ORIENTATION "exif-ifd0-Orientation"
 
@@ -67,9 +73,14 @@ vips_type_find_save_go(int imgtype) {
   case (WEBP):
     return vips_type_find("VipsOperation", "webpsave_buffer");
   case (GIF):
-    return vips_type_find("VipsOperation", "magicksave_buffer");
+#if VIPS_SUPPORT_GIFSAVE
+    return vips_type_find("VipsOperation", "gifsave_buffer");
+#else
+    return 0;
+#endif
   case (ICO):
-    return vips_type_find("VipsOperation", "magicksave_buffer");
+    // ICO is a PNG wrapped in Go
+    return vips_type_find("VipsOperation", "pngsave_buffer");
   }
 
   return 0;
@@ -89,7 +100,16 @@ vips_pngload_go(void *buf, size_t len, VipsImage **out) {
 }
 
 int
-vips_webpload_go(void *buf, size_t len, int shrink, VipsImage **out) {
+vips_webpload_go(void *buf, size_t len, int shrink, int pages, VipsImage **out) {
+#if VIPS_SUPPORT_WEBP_ANIMATION
+  if (pages != 1) {
+    if (shrink > 1)
+      return vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, "n", pages, NULL);
+
+    return vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "n", pages, NULL);
+  }
+#endif
+
   if (shrink > 1)
     return vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, "shrink", shrink, NULL);
 
@@ -137,16 +157,32 @@ vips_support_smartcrop() {
 #endif
 }
 
+// text rendering is built into libvips only along with pango
+int
+vips_support_text() {
+  return vips_type_find("VipsOperation", "text") != 0;
+}
+
 VipsBandFormat
 vips_band_format(VipsImage *in) {
   return in->BandFmt;
 }
 
+// vips_is_animated reports whether more than one page of a GIF or WebP is loaded
 gboolean
-vips_is_animated_gif(VipsImage * in) {
-  return( vips_image_get_typeof(in, "page-height") != G_TYPE_INVALID &&
-          vips_image_get_typeof(in, "gif-delay") != G_TYPE_INVALID &&
-          vips_image_get_typeof(in, "gif-loop") != G_TYPE_INVALID );
+vips_is_animated(VipsImage * in) {
+  int page_height;
+
+  if (vips_image_get_typeof(in, "page-height") == G_TYPE_INVALID ||
+      vips_image_get_int(in, "page-height", &page_height))
+    return FALSE;
+
+  return page_height > 0 && page_height < in->Ysize;
+}
+
+gboolean
+vips_image_has_field_go(VipsImage * in, const char *name) {
+  return vips_image_get_typeof(in, name) != G_TYPE_INVALID;
 }
 
 gboolean
@@ -339,6 +375,30 @@ vips_apply_opacity(VipsImage *in, VipsImage **out, double opacity){
   return 0;
 }
 
+int
+vips_text_go(VipsImage **out, const char *text, const char *font, int dpi, double r, double g, double b) {
+  VipsImage *base = vips_image_new();
+  VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+
+  double a[3] = {1, 1, 1};
+  double ink[3] = {r, g, b};
+
+  // the rendered text is the alpha of a solid ink plane
+  if (vips_text(&t[0], text, "font", font, "dpi", dpi, NULL) ||
+      vips_black(&t[1], t[0]->Xsize, t[0]->Ysize, "bands", 3, NULL) ||
+      vips_linear(t[1], &t[2], a, ink, 3, NULL) ||
+      vips_cast(t[2], &t[3], VIPS_FORMAT_UCHAR, NULL) ||
+      vips_bandjoin2(t[3], t[0], &t[4], NULL) ||
+      vips_copy(t[4], out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL)) {
+    clear_image(&base);
+    return 1;
+  }
+
+  clear_image(&base);
+
+  return 0;
+}
+
 int
 vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, double opacity) {
   VipsImage *wm, *wm_alpha, *tmp;
@@ -461,8 +521,8 @@ vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality)
 
 int
 vips_gifsave_go(VipsImage *in, void **buf, size_t *len) {
-#if VIPS_SUPPORT_MAGICK
-  return vips_magicksave_buffer(in, buf, len, "format", "gif", NULL);
+#if VIPS_SUPPORT_GIFSAVE
+  return vips_gifsave_buffer(in, buf, len, NULL);
 #else
   vips_error("vips_gifsave_go", "Saving GIF is not supported");
   return 1;
@@ -470,12 +530,21 @@ vips_gifsave_go(VipsImage *in, void **buf, size_t *len) {
 }
 
 int
-vips_icosave_go(VipsImage *in, void **buf, size_t *len) {
-#if VIPS_SUPPORT_MAGICK
-  return vips_magicksave_buffer(in, buf, len, "format", "ico", NULL);
-#else
-  vips_error("vips_icosave_go", "Saving ICO is not supported");
-  return 1;
+vips_get_delay_go(VipsImage *in, int **delay, int *n) {
+  *n = 0;
+
+#if VIPS_SUPPORT_ARRAY_INT
+  if (vips_image_get_typeof(in, "delay") == VIPS_TYPE_ARRAY_INT)
+    return vips_image_get_array_int(in, "delay", delay, n);
+#endif
+
+  return 0;
+}
+
+void
+vips_set_delay_go(VipsImage *in, int *delay, int n) {
+#if VIPS_SUPPORT_ARRAY_INT
+  vips_image_set_array_int(in, "delay", delay, n);
 #endif
 }
 
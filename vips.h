@@ -25,17 +25,19 @@ int vips_type_find_save_go(int imgtype);
 
 int vips_jpegload_go(void *buf, size_t len, int shrink, VipsImage **out);
 int vips_pngload_go(void *buf, size_t len, VipsImage **out);
-int vips_webpload_go(void *buf, size_t len, int shrink, VipsImage **out);
+int vips_webpload_go(void *buf, size_t len, int shrink, int pages, VipsImage **out);
 int vips_gifload_go(void *buf, size_t len, int pages, VipsImage **out);
 int vips_svgload_go(void *buf, size_t len, double scale, VipsImage **out);
 
 int vips_get_exif_orientation(VipsImage *image);
 
 int vips_support_smartcrop();
+int vips_support_text();
 
 VipsBandFormat vips_band_format(VipsImage *in);
 
-gboolean vips_is_animated_gif(VipsImage * in);
+gboolean vips_is_animated(VipsImage * in);
+gboolean vips_image_has_field_go(VipsImage * in, const char *name);
 gboolean vips_image_hasalpha_go(VipsImage * in);
 
 int vips_copy_go(VipsImage *in, VipsImage **out);
@@ -66,6 +68,7 @@ int vips_embed_go(VipsImage *in, VipsImage **out, int x, int y, int width, int h
 int vips_ensure_alpha(VipsImage *in, VipsImage **out);
 int vips_apply_opacity(VipsImage *in, VipsImage **out, double opacity);
 
+int vips_text_go(VipsImage **out, const char *text, const char *font, int dpi, double r, double g, double b);
 int vips_apply_watermark(VipsImage *in, VipsImage *watermark, VipsImage **out, double opacity);
 
 int vips_arrayjoin_go(VipsImage **in, VipsImage **out, int n);
@@ -74,6 +77,8 @@ int vips_jpegsave_go(VipsImage *in, void **buf, size_t *len, int strip, int qual
 int vips_pngsave_go(VipsImage *in, void **buf, size_t *len, int interlace, int embed_profile);
 int vips_webpsave_go(VipsImage *in, void **buf, size_t *len, int strip, int quality);
 int vips_gifsave_go(VipsImage *in, void **buf, size_t *len);
-int vips_icosave_go(VipsImage *in, void **buf, size_t *len);
+
+int vips_get_delay_go(VipsImage *in, int **delay, int *n);
+void vips_set_delay_go(VipsImage *in, int *delay, int n);
 
 void vips_cleanup();
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	watermarksMutex sync.RWMutex
+
+	// watermarkPresets are the default options of the named watermarks
+	watermarkPresets = make(map[string]watermarkOptions)
+)
+
+func initWatermarks() {
+	if err := vipsLoadWatermarks(config.Watermarks); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// watermarkData loads the watermark source set in the image config.
+// The first of watermark_data (base64), watermark_path and watermark_object wins.
+func watermarkData() ([]byte, imageType, context.CancelFunc, error) {
+	data, imgtype, err := loadWatermarkSource(config.Image.WatermarkData, config.Image.WatermarkPath, config.Image.WatermarkObject)
+	return data, imgtype, func() {}, err
+}
+
+// loadWatermarkSource returns nil data when no source is set
+func loadWatermarkSource(b64, filePath, objectID string) ([]byte, imageType, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	switch {
+	case len(b64) > 0:
+		data, err = base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, imageTypeUnknown, fmt.Errorf("Can't decode watermark data: %s", err)
+		}
+	case len(filePath) > 0:
+		data, err = ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, imageTypeUnknown, fmt.Errorf("Can't read watermark: %s", err)
+		}
+	case len(objectID) > 0:
+		if data, err = watermarkObjectData(objectID); err != nil {
+			return nil, imageTypeUnknown, fmt.Errorf("Can't fetch watermark: %s", err)
+		}
+	default:
+		return nil, imageTypeUnknown, nil
+	}
+
+	_, imgtypeStr, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, imageTypeUnknown, fmt.Errorf("Can't decode watermark: %s", err)
+	}
+
+	imgtype, imgtypeOk := imageTypes[imgtypeStr]
+	if !imgtypeOk || !vipsTypeSupportLoad[imgtype] {
+		return nil, imageTypeUnknown, errors.New("Watermark type is not supported")
+	}
+
+	return data, imgtype, nil
+}
+
+// watermarkObjectData reads the watermark from the storage, objectID lives in the current bucket
+func watermarkObjectData(objectID string) ([]byte, error) {
+	res, err := doStorageRequest(http.MethodGet, storageObjectURL(objectID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// parseWatermarkConfig turns the defaults into the wm option arguments, so they are checked the same way
+func parseWatermarkConfig(name string, wc watermarkConfig) (watermarkOptions, error) {
+	opacity := wc.Opacity
+	if opacity == 0 {
+		opacity = 1
+	}
+
+	args := []string{
+		strconv.FormatFloat(opacity, 'f', -1, 64),
+		wc.Position,
+		strconv.Itoa(wc.OffsetX),
+		strconv.Itoa(wc.OffsetY),
+		strconv.FormatFloat(wc.Scale, 'f', -1, 64),
+	}
+
+	po := processingOptions{Watermark: watermarkOptions{Gravity: gravityCenter}}
+	if err := applyWatermarkOption(&po, args); err != nil {
+		return watermarkOptions{}, fmt.Errorf("Watermark %s: %s", name, err)
+	}
+
+	po.Watermark.Name = name
+
+	return po.Watermark, nil
+}
+
+func watermarkNames() []string {
+	watermarksMutex.RLock()
+	defer watermarksMutex.RUnlock()
+
+	names := make([]string, 0, len(watermarkPresets))
+	for name := range watermarkPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// reloadWatermarks re-reads the watermarks from the config file and swaps the registry
+func reloadWatermarks(c echo.Context) error {
+	var conf map[string]watermarkConfig
+
+	if err := configViper.ReadInConfig(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := configViper.UnmarshalKey("watermarks", &conf); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	if err := vipsLoadWatermarks(conf); err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	log.Infof("Watermarks reloaded: %v", watermarkNames())
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"watermarks": watermarkNames()})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Webhooks notify downstream services about uploaded and deleted images.
+// Every configured URL gets a JSON POST signed with HMAC-SHA256 of the body:
+//   X-Iris-Signature: sha256=<hex>
+// Failed deliveries are retried with a doubling interval, the ones that run out of
+// attempts are appended to the dead-letter file as JSON lines.
+
+const (
+	webhookEventUpload = "upload"
+	webhookEventDelete = "delete"
+
+	headerWebhookEvent     = "X-Iris-Event"
+	headerWebhookDelivery  = "X-Iris-Delivery"
+	headerWebhookSignature = "X-Iris-Signature"
+)
+
+var (
+	webhookClient *http.Client
+	webhookQueue  chan *webhookDelivery
+	webhookEvents = make(map[string]bool)
+
+	deadLetterMutex sync.Mutex
+)
+
+type webhookDelivery struct {
+	ID       string          `json:"delivery_id"`
+	Event    string          `json:"event"`
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func initWebhooks() {
+	conf := config.Webhooks
+
+	if !conf.Enabled {
+		return
+	}
+
+	if len(conf.URLs) == 0 {
+		log.Fatal("Webhooks are enabled but no urls are set")
+	}
+
+	if len(conf.Secret) == 0 {
+		log.Fatal("Webhooks are enabled but no secret is set")
+	}
+
+	for _, ev := range conf.Events {
+		if ev != webhookEventUpload && ev != webhookEventDelete {
+			log.Fatalf("Unknown webhook event: %s", ev)
+		}
+		webhookEvents[ev] = true
+	}
+
+	// Receivers are ours, so unlike the downloads private addresses are fine
+	webhookClient = &http.Client{Timeout: conf.Timeout}
+	webhookQueue = make(chan *webhookDelivery, maxInt(conf.QueueSize, 1))
+
+	for i := 0; i < maxInt(conf.Workers, 1); i++ {
+		go webhookLoop()
+	}
+}
+
+// notifyWebhooks queues the event for every receiver, it never blocks the request
+func notifyWebhooks(event string, payload map[string]interface{}) {
+	if !config.Webhooks.Enabled || !webhookEvents[event] {
+		return
+	}
+
+	payload["event"] = event
+	payload["timestamp"] = time.Now().Unix()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("Can't encode %s webhook: %s", event, err)
+		return
+	}
+
+	for _, url := range config.Webhooks.URLs {
+		rnd := make([]byte, 16)
+		if _, err := rand.Read(rnd); err != nil {
+			log.Errorf("Can't create %s webhook delivery: %s", event, err)
+			return
+		}
+
+		d := &webhookDelivery{
+			ID:      hex.EncodeToString(rnd),
+			Event:   event,
+			URL:     url,
+			Payload: data,
+		}
+
+		select {
+		case webhookQueue <- d:
+		default:
+			d.Error = "queue is full"
+			writeDeadLetter(d)
+		}
+	}
+}
+
+// webhookPayload describes the stored image for the receivers
+func webhookPayload(c echo.Context) map[string]interface{} {
+	payload := map[string]interface{}{
+		"object_id": c.Get(objectIDKey),
+	}
+
+	if id, err := getImageID(c); err == nil {
+		payload["image_id"] = id
+	}
+
+	if t, ok := c.Get(startTimeKey).(time.Time); ok {
+		payload["duration_ms"] = int(time.Since(t).Seconds() * 1000)
+	}
+
+	return payload
+}
+
+func webhookLoop() {
+	for d := range webhookQueue {
+		delay := config.Webhooks.RetryInterval
+
+		for {
+			err := deliverWebhook(d)
+			if err == nil {
+				if prometheusEnabled {
+					incrementPrometheusWebhookDeliveries(d.Event, "success")
+				}
+				break
+			}
+
+			log.Warnf("Webhook %s to %s failed (attempt %d): %s", d.ID, d.URL, d.Attempts, err)
+
+			if d.Attempts >= config.Webhooks.MaxAttempts {
+				d.Error = err.Error()
+				writeDeadLetter(d)
+				break
+			}
+
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func deliverWebhook(d *webhookDelivery) error {
+	d.Attempts++
+
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(headerWebhookEvent, d.Event)
+	req.Header.Set(headerWebhookDelivery, d.ID)
+	req.Header.Set(headerWebhookSignature, "sha256="+webhookSignature(d.Payload))
+	req.Header.Set("X-Iris-Attempt", strconv.Itoa(d.Attempts))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func webhookSignature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.Webhooks.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func writeDeadLetter(d *webhookDelivery) {
+	log.Errorf("Webhook %s %s to %s is dead: %s", d.ID, d.Event, d.URL, d.Error)
+
+	if prometheusEnabled {
+		incrementPrometheusWebhookDeliveries(d.Event, "dead")
+	}
+
+	if len(config.Webhooks.DeadLetterFile) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(d)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	f, err := os.OpenFile(config.Webhooks.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("Can't open webhook dead-letter file: %s", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Errorf("Can't write webhook dead-letter file: %s", err)
+	}
+}